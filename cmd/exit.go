@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/masahide/rcp/pkg/rcp"
+)
+
+// exit codes of the commands, 4 is reserved for a peer refusing the connection
+// since rcp does not authenticate its peers
+const (
+	exitOK            = 0
+	exitFailure       = 1 // any other error
+	exitUsage         = 2 // invalid flags or arguments
+	exitConnection    = 3 // rcp.ErrConnection
+	exitChecksum      = 5 // rcp.ErrChecksum
+	exitDiskFull      = 6 // rcp.ErrDiskFull
+	exitPeerAborted   = 7 // rcp.ErrPeerAborted
+	exitShortTransfer = 8 // rcp.ErrShortTransfer
+	exitInterrupted   = 9 // stopped by SIGINT, SIGTERM or the dashboard
+)
+
+// exitCode returns the exit code of a transfer that ended with err
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, rcp.ErrPeerAborted):
+		return exitPeerAborted
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, rcp.ErrDiskFull):
+		return exitDiskFull
+	case errors.Is(err, rcp.ErrChecksum):
+		return exitChecksum
+	case errors.Is(err, rcp.ErrShortTransfer):
+		return exitShortTransfer
+	case errors.Is(err, rcp.ErrConnection):
+		return exitConnection
+	}
+	return exitFailure
+}
+
+// usageError prints msg and exits with exitUsage
+func usageError(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(exitUsage)
+}
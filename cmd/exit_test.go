@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/masahide/rcp/pkg/rcp"
+)
+
+func TestExitCode(t *testing.T) {
+	transfer := func(kind error) error { return &rcp.TransferError{Kind: kind, Err: io.EOF} }
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"ok", nil, exitOK},
+		{"other", errors.New("other"), exitFailure},
+		{"connection", transfer(rcp.ErrConnection), exitConnection},
+		{"checksum", transfer(rcp.ErrChecksum), exitChecksum},
+		{"disk full", transfer(rcp.ErrDiskFull), exitDiskFull},
+		{"short", transfer(rcp.ErrShortTransfer), exitShortTransfer},
+		{"peer aborted", fmt.Errorf("send: %w", rcp.ErrPeerAborted), exitPeerAborted},
+		{"interrupted", fmt.Errorf("copy: %w", context.Canceled), exitInterrupted},
+		{"aborted with a connection error", &rcp.TransferError{Kind: rcp.ErrConnection, Err: rcp.ErrPeerAborted}, exitPeerAborted},
+		{"partial output", &rcp.PartialError{Err: transfer(rcp.ErrDiskFull), Name: "out", Offset: 10}, exitDiskFull},
+		{"checksum mode", rcp.ErrChecksumMode, exitFailure},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+	codes := map[int]bool{}
+	for _, c := range []int{exitOK, exitFailure, exitUsage, exitConnection, exitChecksum, exitDiskFull,
+		exitPeerAborted, exitShortTransfer, exitInterrupted} {
+		if codes[c] || c == 4 {
+			t.Errorf("exit code %d is used twice or reserved", c)
+		}
+		codes[c] = true
+	}
+}
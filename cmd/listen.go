@@ -17,13 +17,18 @@ limitations under the License.
 */
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/masahide/rcp/pkg/bytesize"
+	"github.com/masahide/rcp/pkg/rcp"
 	"github.com/spf13/cobra"
 )
 
+var seekString string
+
 // listenCmd represents the listen command
 var listenCmd = &cobra.Command{
 	Use:   "listen",
@@ -34,17 +39,38 @@ example:
 $ rcp listen -l 0.0.0.0:1987 -o outputfile `,
 	Run: func(cmd *cobra.Command, args []string) {
 		r.DummyInput = int64(bytesize.MustParse(dummyInputString))
+		r.MaxMemory = parseSize("maxMemory", maxMemoryString)
+		r.ChunkStoreMax = parseSize("chunkStoreMax", chunkStoreMax)
+		parseSockopts()
+		checkFlags()
 		if len(r.Output) == 0 && !r.DummyOutput {
-			log.Fatal("--output(-o) flag or --dummyOutput flag required")
+			usageError("--output(-o) flag or --dummyOutput flag required")
+		}
+		if len(seekString) > 0 {
+			r.InPlace, r.Seek = true, parseSize("seek", seekString)
 		}
-		_, err := r.ReadWrite()
+		err := readWrite()
 		if err != nil {
 			log.Println(err)
 		}
-		fmt.Println(r.SpeedDashboard.Input.Title)
-		fmt.Println(r.SpeedDashboard.Output.Title)
-		fmt.Println(r.SpeedDashboard.Buffer.Title)
-		fmt.Println(r.SpeedDashboard.Progress.Title)
+		for _, line := range r.SpeedDashboard.Summary() {
+			fmt.Println(line)
+		}
+		if sum := r.Sum(); len(sum) > 0 {
+			fmt.Println("Checksum:", sum)
+		}
+		var partial *rcp.PartialError
+		switch {
+		case errors.As(err, &partial) && len(r.Checkpoint) > 0:
+			fmt.Printf("Resume with: rcp listen --checkpoint %s -o %s, and rcp send --checkpoint <the checkpoint of the sender>\n",
+				r.Checkpoint, r.Output)
+		case errors.As(err, &partial):
+			received := partial.Offset - r.Seek
+			fmt.Printf("Resume with: rcp listen --seek %d -o %s, and rcp send --offset <the previous offset + %d>\n",
+				partial.Offset, r.Output, received)
+		}
+		linger()
+		os.Exit(exitCode(err))
 	},
 }
 
@@ -63,6 +89,8 @@ func init() {
 
 	listenCmd.PersistentFlags().StringVarP(&r.ListenAddr, "listenAddr", "l", r.ListenAddr, "listen address")
 	listenCmd.PersistentFlags().StringVarP(&r.Output, "output", "o", r.Output, "output filename")
+	listenCmd.PersistentFlags().StringVar(&seekString, "seek", seekString, "write into the existing output at this offset without truncating it, or continue its .part file kept by an interrupted transfer (ex: 1GB)")
+	listenCmd.PersistentFlags().BoolVar(&r.Zeroed, "zeroed", r.Zeroed, "the output block device already reads as zeros: leave the holes sent with --sparse unwritten")
 	//flag.BoolVar(&discard, "discard", discard, "discard output")
 	//flag.StringVar(&input, "i", input, "input filename")
 
@@ -0,0 +1,103 @@
+package cmd
+
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/masahide/rcp/pkg/rcp"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replaySpeed  = 1.0
+	replaySVG    = ""
+	replayPNG    = ""
+	replayWidth  = 1200
+	replayHeight = 800
+)
+
+// replayCmd represents the replay command
+var replayCmd = &cobra.Command{
+	Use:   "replay metrics.csv",
+	Short: "Replay a recorded transfer",
+	Long: `Replay metrics recorded with --record in the dashboard, or export them as a chart
+example:
+
+$ rcp replay metrics.csv --speed 10
+$ rcp replay metrics.csv --svg metrics.svg`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		rec, err := rcp.ReadRecording(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(replaySVG) > 0 && replaySVG == replayPNG {
+			usageError("--svg and --png must name different files")
+		}
+		if len(replaySVG) > 0 {
+			if err := writeChart(replaySVG, func(f *os.File) error { return rec.WriteSVG(f, replayWidth, replayHeight) }); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(replayPNG) > 0 {
+			if err := writeChart(replayPNG, func(f *os.File) error { return rec.WritePNG(f, replayWidth, replayHeight) }); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(replaySVG) > 0 || len(replayPNG) > 0 {
+			return
+		}
+		s := rcp.NewSpeedDashboard()
+		if err := rec.Replay(context.Background(), s, replaySpeed); err != nil {
+			log.Fatal(err)
+		}
+		for _, line := range s.Summary() {
+			fmt.Println(line)
+		}
+	},
+}
+
+func writeChart(name string, write func(*os.File) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", replaySpeed, "replay speed-up factor")
+	replayCmd.Flags().StringVar(&replaySVG, "svg", replaySVG, "export the chart to this SVG file instead of replaying")
+	replayCmd.Flags().StringVar(&replayPNG, "png", replayPNG, "export the chart to this PNG file instead of replaying")
+	replayCmd.Flags().IntVar(&replayWidth, "width", replayWidth, "chart width in pixels")
+	replayCmd.Flags().IntVar(&replayHeight, "height", replayHeight, "chart height in pixels")
+}
@@ -17,8 +17,12 @@ limitations under the License.
 */
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -31,16 +35,31 @@ var (
 	cfgFile = ""
 	// Rcp configs
 	dummyInputString string
+	maxMemoryString  string
+	chunkStoreMax    string
+	sndBufString     string
+	rcvBufString     string
+	noDelay          = true
+	tos              = -1
+	dscp             = -1
 	r                = &rcp.Rcp{
-		MaxBufNum:    100,
-		BufSize:      10 * 1024 * 1024, // 10MByte
-		SingleThread: false,
-		DummyInput:   0,
-		DummyOutput:  false,
-		DialAddr:     "",
-		Output:       "",
-		Input:        "",
-		ListenAddr:   "0.0.0.0:1987",
+		MaxBufNum:     rcp.DefaultMaxBufNum,
+		BufSize:       rcp.DefaultBufSize,
+		SingleThread:  false,
+		DummyInput:    0,
+		DummyOutput:   false,
+		DialAddr:      "",
+		Output:        "",
+		Input:         "",
+		ListenAddr:    "0.0.0.0:1987",
+		SpeedWindow:   rcp.DefaultSpeedWindow,
+		QueueDepth:    32,
+		Readers:       1,
+		Writers:       1,
+		Fsync:         rcp.FsyncNone,
+		FsyncInterval: 5 * time.Second,
+		RetryBackoff:  time.Second,
+		MetricsLinger: 30 * time.Second,
 	}
 )
 
@@ -79,10 +98,30 @@ $ rcp send -d 10.10.10.10:1987 -i input_filename`,
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 }
 
+// readWrite runs the transfer until it completes or SIGINT or SIGTERM interrupts it,
+// a second signal kills the process
+func readWrite() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	_, err := r.ReadWriteContext(ctx)
+	return err
+}
+
+// linger keeps serving --metrics-addr and --web after the summary until --metrics-linger or a signal
+func linger() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r.Linger(ctx)
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
@@ -93,9 +132,42 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", cfgFile, "config file (default is $HOME/.rcp.yaml)")
 	rootCmd.PersistentFlags().IntVar(&r.MaxBufNum, "maxBufNum", r.MaxBufNum, "Maximum number of buffers (with thread copy mode)")
 	rootCmd.PersistentFlags().IntVar(&r.BufSize, "bufSize", r.BufSize, "Buffer size(with thread copy mode)")
+	rootCmd.PersistentFlags().StringVar(&maxMemoryString, "maxMemory", maxMemoryString, "size and count the buffers from the observed throughput within this memory budget, instead of --bufSize and --maxBufNum (ex: 256MB, at least 1MB or 256KB per --queueDepth+2 with --uring)")
 	rootCmd.PersistentFlags().BoolVarP(&r.SingleThread, "singlThread", "s", r.SingleThread, "Single thread mode")
+	rootCmd.PersistentFlags().BoolVar(&r.ZeroCopy, "zeroCopy", r.ZeroCopy, "zero-copy mode using sendfile/splice (Linux only)")
+	rootCmd.PersistentFlags().BoolVar(&r.Direct, "direct", r.Direct, "open --input/--output with O_DIRECT to bypass the page cache (Linux only)")
+	rootCmd.PersistentFlags().BoolVar(&r.Uring, "uring", r.Uring, "read and write files with io_uring (Linux 5.6+)")
+	rootCmd.PersistentFlags().BoolVar(&r.Mmap, "mmap", r.Mmap, "read the input file through a memory mapping instead of buffers (Linux only)")
+	rootCmd.PersistentFlags().IntVar(&r.QueueDepth, "queueDepth", r.QueueDepth, "number of io_uring requests in flight (with --uring)")
+	rootCmd.PersistentFlags().IntVar(&r.Readers, "readers", r.Readers, "number of parallel readers of the input file")
+	rootCmd.PersistentFlags().IntVar(&r.Writers, "writers", r.Writers, "number of parallel writers of the output file")
+	rootCmd.PersistentFlags().BoolVar(&r.Sparse, "sparse", r.Sparse, "send holes and all-zero blocks of the input as holes instead of bytes")
+	rootCmd.PersistentFlags().StringVar(&r.Fsync, "fsync", r.Fsync, "fsync policy of the output file: none, end or interval")
+	rootCmd.PersistentFlags().DurationVar(&r.FsyncInterval, "fsyncInterval", r.FsyncInterval, "fsync period (with --fsync=interval)")
+	rootCmd.PersistentFlags().StringVar(&sndBufString, "sndbuf", sndBufString, "socket send buffer size of the connection (ex: 16MB)")
+	rootCmd.PersistentFlags().StringVar(&rcvBufString, "rcvbuf", rcvBufString, "socket receive buffer size of the connection (ex: 16MB)")
+	rootCmd.PersistentFlags().BoolVar(&noDelay, "nodelay", noDelay, "send small segments without waiting (TCP_NODELAY), --nodelay=false enables Nagle's algorithm")
+	rootCmd.PersistentFlags().StringVar(&r.Congestion, "congestion", r.Congestion, "TCP congestion control algorithm of the connection: bbr, cubic, ... (Linux only)")
+	rootCmd.PersistentFlags().IntVar(&r.MSS, "mss", r.MSS, "TCP maximum segment size of the connection (Linux only)")
+	rootCmd.PersistentFlags().IntVar(&tos, "tos", tos, "IP TOS byte (IPv6 traffic class) of the connection (ex: 0x10, Linux only)")
+	rootCmd.PersistentFlags().IntVar(&dscp, "dscp", dscp, "DSCP of the connection, the upper 6 bits of --tos (ex: 46, Linux only)")
+	rootCmd.PersistentFlags().DurationVar(&r.KeepAlive, "keepAlive", r.KeepAlive, "TCP keepalive interval of the connection, negative to disable (default 15s)")
+	rootCmd.PersistentFlags().DurationVar(&r.UserTimeout, "userTimeout", r.UserTimeout, "drop the connection when sent data stays unacknowledged this long (TCP_USER_TIMEOUT, Linux only)")
+	rootCmd.PersistentFlags().StringVar(&r.Checkpoint, "checkpoint", r.Checkpoint, "journal the bytes the listener acknowledged as durable in this file, and resume the transfer it describes after a restart")
+	rootCmd.PersistentFlags().StringSliceVar(&r.Preserve, "preserve", r.Preserve, "metadata the sender sends and the listener applies, each side lists its own: mode,owner,times,xattr,setid")
+	rootCmd.PersistentFlags().BoolVar(&r.Delta, "delta", r.Delta, "send only the blocks that differ from the listener's existing --output")
+	rootCmd.PersistentFlags().BoolVar(&r.CDC, "cdc", r.CDC, "split the input into content-defined chunks and send only the chunks missing from the listener's chunk store")
+	rootCmd.PersistentFlags().StringVar(&r.ChunkStore, "chunkStore", r.ChunkStore, "directory of the chunks received with --cdc (default .rcp-chunks next to --output)")
+	rootCmd.PersistentFlags().StringVar(&chunkStoreMax, "chunkStoreMax", chunkStoreMax, "evict the least recently used chunks after a --cdc transfer until --chunkStore is within this size (ex: 50GB)")
 	rootCmd.PersistentFlags().StringVar(&dummyInputString, "dummyInput", dummyInputString, "dummy input mode data size (ex: 100MB, 4K, 10g)")
 	rootCmd.PersistentFlags().BoolVar(&r.DummyOutput, "dummyOutput", r.DummyOutput, "dummy output mode")
+	rootCmd.PersistentFlags().DurationVar(&r.SpeedWindow, "speedWindow", r.SpeedWindow, "moving window for the average speed and ETA")
+	rootCmd.PersistentFlags().StringVar(&r.ReportFile, "report", r.ReportFile, "write a JSON report of the transfer to this file")
+	rootCmd.PersistentFlags().BoolVar(&r.Checksum, "checksum", r.Checksum, "print the SHA-256 of the data and add it to --report, on the buffered copy only")
+	rootCmd.PersistentFlags().StringVar(&r.RecordFile, "record", r.RecordFile, "record every metrics sample to this CSV file")
+	rootCmd.PersistentFlags().StringVar(&r.MetricsAddr, "metrics-addr", r.MetricsAddr, "serve Prometheus metrics on this address (ex: :9187)")
+	rootCmd.PersistentFlags().DurationVar(&r.MetricsLinger, "metrics-linger", r.MetricsLinger, "keep serving --metrics-addr and --web this long after the transfer, to scrape and show its final state")
+	rootCmd.PersistentFlags().StringVar(&r.WebAddr, "web", r.WebAddr, "serve the web dashboard on this address (ex: :8080)")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -126,3 +198,35 @@ func initConfig() {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// checkFlags rejects the flags shared by send and listen that cannot work together
+func checkFlags() {
+	if err := rcp.CheckPreserve(r.Preserve); err != nil {
+		usageError(fmt.Sprintf("--preserve: %s", err))
+	}
+	if r.Checksum && (r.ZeroCopy || r.Uring || r.Writers > 1) {
+		usageError("--checksum cannot be combined with --zeroCopy, --uring or --writers")
+	}
+	if err := r.CheckMaxMemory(); err != nil {
+		usageError(fmt.Sprintf("--maxMemory: %s", err))
+	}
+}
+
+// parseSockopts parses the socket option flags shared by send and listen
+func parseSockopts() {
+	r.SndBuf = int(parseSize("sndbuf", sndBufString))
+	r.RcvBuf = int(parseSize("rcvbuf", rcvBufString))
+	r.Nagle = !noDelay
+	switch {
+	case tos >= 0 && dscp >= 0:
+		usageError("--tos and --dscp cannot be combined")
+	case tos > 255:
+		usageError(fmt.Sprintf("--tos: %d is out of range 0-255", tos))
+	case dscp > 63:
+		usageError(fmt.Sprintf("--dscp: %d is out of range 0-63", dscp))
+	case dscp >= 0:
+		r.TOS = dscp << 2
+	case tos >= 0:
+		r.TOS = tos
+	}
+}
@@ -19,11 +19,17 @@ limitations under the License.
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/masahide/rcp/pkg/bytesize"
 	"github.com/spf13/cobra"
 )
 
+var (
+	offsetString string
+	lengthString string
+)
+
 // sendCmd represents the send command
 var sendCmd = &cobra.Command{
 	Use:   "send",
@@ -34,20 +40,41 @@ example:
 $ rcp send -d 10.10.10.10:1987 -i input_filename`,
 	Run: func(cmd *cobra.Command, args []string) {
 		r.DummyInput = int64(bytesize.MustParse(dummyInputString))
+		r.MaxMemory = parseSize("maxMemory", maxMemoryString)
 		if len(r.DialAddr) == 0 && r.DummyInput == 0 {
-			log.Fatal("--dialAddr(-d) flag or --dummyInput flag required")
+			usageError("--dialAddr(-d) flag or --dummyInput flag required")
 		}
-		_, err := r.ReadWrite()
+		r.Offset = parseSize("offset", offsetString)
+		r.Length = parseSize("length", lengthString)
+		parseSockopts()
+		checkFlags()
+		err := readWrite()
 		if err != nil {
 			log.Println(err)
 		}
-		fmt.Println(r.SpeedDashboard.Input.Title)
-		fmt.Println(r.SpeedDashboard.Output.Title)
-		fmt.Println(r.SpeedDashboard.Buffer.Title)
-		fmt.Println(r.SpeedDashboard.Progress.Title)
+		for _, line := range r.SpeedDashboard.Summary() {
+			fmt.Println(line)
+		}
+		if sum := r.Sum(); len(sum) > 0 {
+			fmt.Println("Checksum:", sum)
+		}
+		linger()
+		os.Exit(exitCode(err))
 	},
 }
 
+// parseSize parses the value of a size flag, 0 if it is not set
+func parseSize(name, s string) int64 {
+	if len(s) == 0 {
+		return 0
+	}
+	n, err := bytesize.Parse(s)
+	if err != nil {
+		usageError(fmt.Sprintf("--%s: %s", name, err))
+	}
+	return int64(n)
+}
+
 func init() {
 	rootCmd.AddCommand(sendCmd)
 
@@ -58,6 +85,10 @@ func init() {
 	// sendCmd.PersistentFlags().String("foo", "", "A help for foo")
 	sendCmd.PersistentFlags().StringVarP(&r.Input, "input", "i", r.Input, "input filename")
 	sendCmd.PersistentFlags().StringVarP(&r.DialAddr, "dialAddr", "d", r.DialAddr, "dial address (ex: 198.51.100.1:1987 )")
+	sendCmd.PersistentFlags().StringVar(&offsetString, "offset", offsetString, "first byte of the input to send (ex: 1GB)")
+	sendCmd.PersistentFlags().IntVar(&r.Retries, "retries", r.Retries, "redial the listener up to this many times when the connection fails, and continue where it stopped")
+	sendCmd.PersistentFlags().DurationVar(&r.RetryBackoff, "retry-backoff", r.RetryBackoff, "wait before the first redial, doubled for every next one (with --retries)")
+	sendCmd.PersistentFlags().StringVar(&lengthString, "length", lengthString, "bytes of the input to send, up to the end if not set (ex: 100MB)")
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
@@ -0,0 +1,91 @@
+package rcp
+
+import "time"
+
+// limits of the adaptive buffers
+const (
+	minAdaptiveBuf    = 256 * 1024
+	maxAdaptiveBuf    = 16 * 1024 * 1024
+	minAdaptiveBufNum = 4
+	startAdaptiveBuf  = 1024 * 1024
+)
+
+// adaptiveBuffers resizes the buffers of a transfer from its observed throughput within a memory budget
+type adaptiveBuffers struct {
+	budget int64
+	minNum int
+}
+
+func newAdaptiveBuffers(budget int64, queueDepth int) *adaptiveBuffers {
+	a := &adaptiveBuffers{budget: budget, minNum: minAdaptiveBufNum}
+	if queueDepth+2 > a.minNum {
+		// io_uring keeps queueDepth buffers in flight
+		a.minNum = queueDepth + 2
+	}
+	return a
+}
+
+// minBudget returns the memory of the fewest and smallest buffers, the least budget a transfer runs with
+func (a *adaptiveBuffers) minBudget() int64 {
+	return int64(a.minNum) * minAdaptiveBuf
+}
+
+// maxNum returns the most buffers that fit in the budget
+func (a *adaptiveBuffers) maxNum() int {
+	return int(a.budget / minAdaptiveBuf)
+}
+
+// initial returns the size and number of the buffers to start with
+func (a *adaptiveBuffers) initial() (size, n int) {
+	return a.fit(startAdaptiveBuf, 16)
+}
+
+// fit raises the number of the buffers to minNum, then shrinks their number and size into the budget,
+// which CheckMaxMemory keeps at least minBudget so that minNum buffers always fit
+func (a *adaptiveBuffers) fit(size, n int) (int, int) {
+	if n < a.minNum {
+		n = a.minNum
+	}
+	want := n
+	if max := int(a.budget / int64(size)); n > max {
+		n = max
+	}
+	for n < a.minNum && size > minAdaptiveBuf {
+		size /= 2
+		if n = int(a.budget / int64(size)); n > want {
+			n = want
+		}
+	}
+	return size, n
+}
+
+// adapt resizes bs from the speeds of the last second in m and the chunks queued for the writer
+func (a *adaptiveBuffers) adapt(bs *buffers, m Metrics, queued int) {
+	u := bs.usage()
+	rate := m.InputByteSec
+	if rate < m.OutputByteSec {
+		rate = m.OutputByteSec
+	}
+	// about 32 buffers a second, so a stage never waits long for a full one,
+	// but not much larger than the reads fill them
+	target := minAdaptiveBuf
+	for target < maxAdaptiveBuf && uint64(target)*32 < rate &&
+		(u.gets == 0 || uint64(target) < rate/uint64(u.gets)) {
+		target *= 2
+	}
+	n := u.max
+	switch stalled := u.waited > 50*time.Millisecond; {
+	case stalled && queued < n/2:
+		// the reader waited for buffers held by the writer: more in flight help
+		n *= 2
+	case stalled:
+		// the writer is behind: keep a quarter of a second queued to absorb its stalls
+		n = n * 3 / 4
+		if floor := int(rate / 4 / uint64(target)); n < floor {
+			n = floor
+		}
+	case u.peak < n/2:
+		n = u.peak * 2
+	}
+	bs.resize(a.fit(target, n))
+}
@@ -0,0 +1,124 @@
+package rcp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+func TestAdaptiveFit(t *testing.T) {
+	tests := []struct {
+		name              string
+		budget            int64
+		queueDepth        int
+		size, n           int
+		wantSize, wantNum int
+	}{
+		{"within the budget", 64 * mb, 0, mb, 16, mb, 16},
+		{"fewer buffers", 8 * mb, 0, mb, 16, mb, 8},
+		{"smaller buffers", 2 * mb, 0, mb, 16, mb / 2, 4},
+		{"smallest buffers", mb, 0, mb, 16, minAdaptiveBuf, 4},
+		{"large buffers", 4 * mb, 0, 16 * mb, 4, mb, 4},
+		{"many small buffers", 10 * mb, 0, minAdaptiveBuf, 100, minAdaptiveBuf, 40},
+		{"up to the fewest", 64 * mb, 0, mb, 1, mb, minAdaptiveBufNum},
+		{"uring", 4 * mb, 6, mb, 16, mb / 2, 8},
+		{"uring below the fewest", mb, 4, mb, 16, minAdaptiveBuf, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdaptiveBuffers(tt.budget, tt.queueDepth)
+			size, n := a.fit(tt.size, tt.n)
+			if size != tt.wantSize || n != tt.wantNum {
+				t.Fatalf("fit(%d, %d) = %d, %d, want %d, %d", tt.size, tt.n, size, n, tt.wantSize, tt.wantNum)
+			}
+			if int64(size)*int64(n) > tt.budget {
+				t.Fatalf("fit(%d, %d) = %d buffers of %d over the budget %d", tt.size, tt.n, n, size, tt.budget)
+			}
+		})
+	}
+}
+
+func TestAdaptiveInitial(t *testing.T) {
+	tests := []struct {
+		budget            int64
+		wantSize, wantNum int
+	}{
+		{mb, minAdaptiveBuf, 4},
+		{4 * mb, mb, 4},
+		{16 * mb, mb, 16},
+		{1024 * mb, mb, 16},
+	}
+	for _, tt := range tests {
+		a := newAdaptiveBuffers(tt.budget, 0)
+		if size, n := a.initial(); size != tt.wantSize || n != tt.wantNum {
+			t.Errorf("initial() with %d = %d, %d, want %d, %d", tt.budget, size, n, tt.wantSize, tt.wantNum)
+		}
+		if got, want := a.maxNum(), int(tt.budget/minAdaptiveBuf); got != want {
+			t.Errorf("maxNum() with %d = %d, want %d", tt.budget, got, want)
+		}
+	}
+}
+
+func TestCheckMaxMemory(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxMemory  int64
+		uring      bool
+		queueDepth int
+		maxBufNum  int
+		err        error
+	}{
+		{"unlimited", 0, false, 0, 64, nil},
+		{"fewest buffers", 4 * minAdaptiveBuf, false, 0, 64, nil},
+		{"below the fewest", 4*minAdaptiveBuf - 1, false, 0, 64, ErrMaxMemory},
+		{"queueDepth without uring", mb, false, 32, 64, nil},
+		{"uring", 34 * minAdaptiveBuf, true, 32, 64, nil},
+		{"uring below its queue", 33 * minAdaptiveBuf, true, 32, 64, ErrMaxMemory},
+		{"uring queue capped", 18 * minAdaptiveBuf, true, 32, 16, nil},
+	}
+	for _, tt := range tests {
+		rcp := &Rcp{MaxMemory: tt.maxMemory, Uring: tt.uring, QueueDepth: tt.queueDepth, MaxBufNum: tt.maxBufNum}
+		if err := rcp.CheckMaxMemory(); !errors.Is(err, tt.err) {
+			t.Errorf("%s: CheckMaxMemory() error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAdaptiveAdapt(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     uint64
+		gets     int
+		peak     int
+		waited   time.Duration
+		queued   int
+		wantSize int
+		wantNum  int
+	}{
+		{"idle", 0, 0, 0, 0, 0, minAdaptiveBuf, 4},
+		{"fast", 1024 * mb, 128, 8, 0, 0, 8 * mb, 8},
+		{"faster than the reads", 1024 * mb, 16, 8, 0, 0, maxAdaptiveBuf, 4},
+		{"reader waits", 64 * mb, 64, 8, time.Second, 0, mb, 16},
+		{"writer behind", 64 * mb, 64, 8, time.Second, 8, mb, 16},
+		{"mostly unused", 16 * mb, 32, 2, 0, 0, mb / 2, 4},
+		{"one in use", 16 * mb, 32, 1, 0, 0, mb / 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const budget = 64 * mb
+			a := newAdaptiveBuffers(budget, 0)
+			bs := newBuffers(mb, 8)
+			bs.peak, bs.gets, bs.waited = tt.peak, tt.gets, tt.waited
+			a.adapt(bs, Metrics{InputByteSec: tt.rate}, tt.queued)
+			u := bs.usage()
+			if u.size != tt.wantSize || u.max != tt.wantNum {
+				t.Fatalf("adapt() resized to %d buffers of %d, want %d of %d", u.max, u.size, tt.wantNum, tt.wantSize)
+			}
+			if int64(u.size)*int64(u.max) > budget {
+				t.Fatalf("%d buffers of %d over the budget", u.max, u.size)
+			}
+		})
+	}
+}
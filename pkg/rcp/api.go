@@ -0,0 +1,92 @@
+package rcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// defaults of the command line and of Copy
+const (
+	DefaultBufSize     = 10 * 1024 * 1024 // 10MByte
+	DefaultMaxBufNum   = 100
+	DefaultSpeedWindow = 10 * time.Second
+)
+
+// ErrOption error type of an option out of range
+var ErrOption = errors.New("The buffer size and the number of buffers, readers and writers must be positive")
+
+// Option configures Copy
+type Option func(*Rcp)
+
+// WithBufSize sets the size of the buffers
+func WithBufSize(n int) Option { return func(rcp *Rcp) { rcp.BufSize = n } }
+
+// WithMaxBufNum sets the maximum number of buffers
+func WithMaxBufNum(n int) Option { return func(rcp *Rcp) { rcp.MaxBufNum = n } }
+
+// WithMaxMemory sizes and counts the buffers from the observed throughput within n bytes
+func WithMaxMemory(n int64) Option { return func(rcp *Rcp) { rcp.MaxMemory = n } }
+
+// WithReaders reads a regular file src from n goroutines
+func WithReaders(n int) Option { return func(rcp *Rcp) { rcp.Readers = n } }
+
+// WithWriters writes from n goroutines when dst supports it
+func WithWriters(n int) Option { return func(rcp *Rcp) { rcp.Writers = n } }
+
+// WithSize sets the expected size of src for the progress and the ETA
+func WithSize(n int64) Option { return func(rcp *Rcp) { rcp.TotalSize = n } }
+
+// WithSpeedWindow sets the moving window of the average speed and the ETA
+func WithSpeedWindow(d time.Duration) Option { return func(rcp *Rcp) { rcp.SpeedWindow = d } }
+
+// WithObserver reports the metrics samples and the end of the copy to o
+func WithObserver(o Observer) Option {
+	return func(rcp *Rcp) { rcp.Observers = append(rcp.Observers, o) }
+}
+
+// WithProgress calls fn with every metrics sample, about once a second and at the end
+func WithProgress(fn func(Metrics)) Option { return WithObserver(ProgressFunc(fn)) }
+
+// ProgressFunc an Observer calling the function with every metrics sample
+type ProgressFunc func(m Metrics)
+
+// Observe calls f
+func (f ProgressFunc) Observe(m Metrics) { f(m) }
+
+// Done does nothing
+func (f ProgressFunc) Done(err error) {}
+
+// Copy copies src to dst through the buffered pipeline of rcp until src ends or ctx is done.
+// Once ctx is done it returns ctx.Err() without waiting for a Read blocked on a src that has no
+// SetDeadline method, like an io.PipeReader or an HTTP body: the goroutine reading src exits when
+// that Read returns, and never writes to dst.
+// It never uses the terminal; the progress goes to the observers given in opts.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, opts ...Option) (n int64, err error) {
+	rcp := &Rcp{
+		MaxBufNum:      DefaultMaxBufNum,
+		BufSize:        DefaultBufSize,
+		Readers:        1,
+		Writers:        1,
+		SpeedWindow:    DefaultSpeedWindow,
+		SpeedDashboard: newHeadlessDashboard(),
+	}
+	for _, opt := range opts {
+		opt(rcp)
+	}
+	if rcp.BufSize <= 0 || rcp.MaxBufNum <= 0 || rcp.Readers <= 0 || rcp.Writers <= 0 {
+		return 0, ErrOption
+	}
+	if err := rcp.CheckMaxMemory(); err != nil {
+		return 0, err
+	}
+	defer func() {
+		for _, o := range rcp.Observers {
+			o.Done(err)
+		}
+	}()
+	tc := rcp.newThreadCopy(dst, src)
+	n, err = rcp.monitoredCopy(ctx, tc, tc.bufCopy)
+	return n, classify(err)
+}
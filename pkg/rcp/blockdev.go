@@ -0,0 +1,28 @@
+package rcp
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrDeviceSize error type of an output block device too small for the input
+var ErrDeviceSize = errors.New("The output device is smaller than the input")
+
+func isBlockDevice(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// fileSize returns the size of a regular file or a block device, -1 for other files
+func fileSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return fi.Size(), nil
+	case isBlockDevice(fi):
+		return deviceSize(f)
+	}
+	return -1, nil
+}
@@ -0,0 +1,29 @@
+package rcp
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// blkZeroOut the BLKZEROOUT ioctl, _IO(0x12, 127)
+const blkZeroOut = 0x127f
+
+// deviceSize returns the size of the block device f
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); e != 0 {
+		return 0, e
+	}
+	return int64(size), nil
+}
+
+// zeroOut zeroes n bytes at off of the block device f, both multiples of 512
+func zeroOut(f *os.File, off, n int64) error {
+	r := [2]uint64{uint64(off), uint64(n)}
+	if _, _, e := unix.Syscall(unix.SYS_IOCTL, f.Fd(), blkZeroOut, uintptr(unsafe.Pointer(&r))); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package rcp
+
+import (
+	"io"
+	"os"
+)
+
+// deviceSize returns the size of the block device f
+func deviceSize(f *os.File) (int64, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(pos, io.SeekStart)
+	return size, err
+}
+
+func zeroOut(f *os.File, off, n int64) error { return errUnsupported }
@@ -0,0 +1,429 @@
+package rcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// FastCDC chunk sizes
+const (
+	cdcMin = 16 * 1024
+	cdcAvg = 64 * 1024
+	cdcMax = 256 * 1024
+
+	cdcMaskS = uint64(1<<18-1) << 46 // harder to match before cdcAvg
+	cdcMaskL = uint64(1<<14-1) << 50 // easier after it
+
+	cdcEntrySize = sha256.Size + 4
+	cdcBatch     = 1 << 16 // chunks listed in a frame, each answered with the bitmap of the wanted ones
+)
+
+// ErrChunk error type of a chunk that does not match its hash
+var ErrChunk = errors.New("The chunk does not match its hash")
+
+// gear random values of the gear hash, the same on every run so chunks repeat across transfers
+var gear = func() (g [256]uint64) {
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range g {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		g[i] = z ^ z>>31
+	}
+	return
+}()
+
+// cdcCut returns the length of the first chunk of b
+func cdcCut(b []byte) int {
+	n := len(b)
+	if n <= cdcMin {
+		return n
+	}
+	if n > cdcMax {
+		n = cdcMax
+	}
+	normal := cdcAvg
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := cdcMin
+	for ; i < normal; i++ {
+		if h = h<<1 + gear[b[i]]; h&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		if h = h<<1 + gear[b[i]]; h&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// cdcChunk a content-defined chunk of the input
+type cdcChunk struct {
+	sum  [sha256.Size]byte
+	size int
+}
+
+// chunkFile splits n bytes at off of the file name into content-defined chunks
+func chunkFile(name string, off, n int64) ([]cdcChunk, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := io.NewSectionReader(f, off, n)
+	var chunks []cdcChunk
+	buf := make([]byte, 0, 4*1024*1024)
+	eof := false
+	for !eof || len(buf) > 0 {
+		if !eof && len(buf) < cdcMax {
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n := cdcCut(buf)
+		chunks = append(chunks, cdcChunk{sha256.Sum256(buf[:n]), n})
+		buf = buf[:copy(buf, buf[n:])]
+	}
+	return chunks, nil
+}
+
+func marshalChunks(chunks []cdcChunk) []byte {
+	b := make([]byte, 0, len(chunks)*cdcEntrySize)
+	var size [4]byte
+	for _, c := range chunks {
+		binary.BigEndian.PutUint32(size[:], uint32(c.size))
+		b = append(append(b, c.sum[:]...), size[:]...)
+	}
+	return b
+}
+
+func unmarshalChunks(b []byte) ([]cdcChunk, error) {
+	if len(b)%cdcEntrySize != 0 {
+		return nil, ErrProtocol
+	}
+	chunks := make([]cdcChunk, 0, len(b)/cdcEntrySize)
+	for ; len(b) > 0; b = b[cdcEntrySize:] {
+		var c cdcChunk
+		copy(c.sum[:], b)
+		if c.size = int(binary.BigEndian.Uint32(b[sha256.Size:])); c.size == 0 || c.size > cdcMax {
+			return nil, ErrProtocol
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, nil
+}
+
+// chunkStore directory of chunks received before, named by their hash
+type chunkStore struct {
+	dir   string
+	max   int64     // bytes kept after a transfer, 0 keeps every chunk
+	since time.Time // start of the transfer, the chunks it uses are not evicted
+}
+
+func (s *chunkStore) path(sum [sha256.Size]byte) string {
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+// has reports whether the store holds c, and marks it as used by the transfer
+func (s *chunkStore) has(c cdcChunk) bool {
+	name := s.path(c.sum)
+	fi, err := os.Stat(name)
+	if err != nil || fi.Size() != int64(c.size) {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return true
+}
+
+func (s *chunkStore) get(c cdcChunk) ([]byte, error) {
+	b, err := os.ReadFile(s.path(c.sum))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != c.size || sha256.Sum256(b) != c.sum {
+		return nil, fmt.Errorf("%w: %s", ErrChunk, s.path(c.sum))
+	}
+	return b, nil
+}
+
+func (s *chunkStore) put(c cdcChunk, b []byte) (err error) {
+	name := s.path(c.sum)
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// prune evicts the chunks least recently used before the transfer until the store holds max bytes
+func (s *chunkStore) prune() error {
+	if s.max <= 0 {
+		return nil
+	}
+	type entry struct {
+		name string
+		size int64
+		used time.Time
+	}
+	var old []entry
+	var total int64
+	// a filesystem may keep the times in whole seconds
+	since := s.since.Truncate(time.Second)
+	err := filepath.WalkDir(s.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || len(d.Name()) != 2*sha256.Size {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			// removed by another listener
+			return nil
+		}
+		total += fi.Size()
+		if fi.ModTime().Before(since) {
+			old = append(old, entry{name, fi.Size(), fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(old, func(i, j int) bool { return old[i].used.Before(old[j].used) })
+	for _, e := range old {
+		if total <= s.max {
+			break
+		}
+		if err := os.Remove(e.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// cdcReader state of a listener receiving only the chunks missing from its store
+type cdcReader struct {
+	store  *chunkStore
+	chunks []cdcChunk
+	wanted []bool
+	i      int    // current chunk
+	buf    []byte // the current chunk read from the store, or the part received so far
+	off    int    // bytes of buf already returned
+	pruned bool   // the store was pruned after the last chunk
+}
+
+// cdcWriter sends only the chunks the listener wants
+type cdcWriter struct {
+	pw     *protoWriter
+	chunks []cdcChunk
+	wanted []bool
+	i      int // current chunk
+	off    int // bytes of the current chunk written
+}
+
+// ErrChunkList error type of an input that no longer matches its chunk list
+var ErrChunkList = errors.New("The input changed after it was split into chunks")
+
+func (c *cdcWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		if c.i >= len(c.chunks) {
+			return total - len(p), ErrChunkList
+		}
+		n := c.chunks[c.i].size - c.off
+		if n > len(p) {
+			n = len(p)
+		}
+		if c.wanted[c.i] {
+			if _, err := c.pw.writeData(p[:n]); err != nil {
+				return total - len(p), err
+			}
+		}
+		p = p[n:]
+		if c.off += n; c.off == c.chunks[c.i].size {
+			c.i, c.off = c.i+1, 0
+		}
+	}
+	return total, nil
+}
+
+// cdc sends the chunk list of the input in frames of cdcBatch chunks ended by an empty one,
+// and reads which chunks of each frame the listener wants
+func (pw *protoWriter) cdc(chunks []cdcChunk) error {
+	wanted := make([]bool, 0, len(chunks))
+	for len(wanted) < len(chunks) {
+		batch := chunks[len(wanted):]
+		if len(batch) > cdcBatch {
+			batch = batch[:cdcBatch]
+		}
+		if err := writeMessage(pw.conn, frameChunks, marshalChunks(batch)); err != nil {
+			return err
+		}
+		b, err := readFrame(pw.conn, frameWanted, (cdcBatch+7)/8)
+		if err != nil {
+			return err
+		}
+		if len(b) != (len(batch)+7)/8 {
+			return ErrProtocol
+		}
+		wanted = append(wanted, unpackBits(b, len(batch))...)
+	}
+	if err := writeMessage(pw.conn, frameChunks, nil); err != nil {
+		return err
+	}
+	pw.chunks = &cdcWriter{pw: pw, chunks: chunks, wanted: wanted}
+	return nil
+}
+
+// cdc reads the chunk list of the sender and answers each frame with the chunks missing from store
+func (pr *protoReader) cdc(w io.Writer, store *chunkStore) error {
+	store.since = time.Now()
+	c := &cdcReader{store: store}
+	seen := map[[sha256.Size]byte]bool{}
+	for {
+		b, err := readFrame(pr.rc, frameChunks, cdcBatch*cdcEntrySize)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&pr.wire, uint64(frameHeaderSize+len(b)))
+		if len(b) == 0 {
+			break
+		}
+		chunks, err := unmarshalChunks(b)
+		if err != nil {
+			return err
+		}
+		wanted := make([]bool, len(chunks))
+		for i, ch := range chunks {
+			// a chunk repeated in the input is in the store once its first copy arrived
+			wanted[i] = !seen[ch.sum] && !c.store.has(ch)
+			seen[ch.sum] = true
+		}
+		if err = writeMessage(w, frameWanted, packBits(wanted)); err != nil {
+			return err
+		}
+		c.chunks, c.wanted = append(c.chunks, chunks...), append(c.wanted, wanted...)
+	}
+	pr.chunks = c
+	return nil
+}
+
+// readChunks reads the current chunk, from the store or from the sender
+func (pr *protoReader) readChunks(b []byte) (int, error) {
+	c := pr.chunks
+	if c.i == len(c.chunks) {
+		return 0, pr.finish()
+	}
+	ch := c.chunks[c.i]
+	if !c.wanted[c.i] {
+		if c.buf == nil {
+			var err error
+			if c.buf, err = c.store.get(ch); err != nil {
+				return 0, err
+			}
+		}
+		n := copy(b, c.buf[c.off:])
+		if c.off += n; c.off == ch.size {
+			c.i, c.buf, c.off = c.i+1, nil, 0
+		}
+		return n, nil
+	}
+	if len(b) > ch.size-len(c.buf) {
+		b = b[:ch.size-len(c.buf)]
+	}
+	n, err := pr.readData(b)
+	c.buf = append(c.buf, b[:n]...)
+	if len(c.buf) == ch.size {
+		if sha256.Sum256(c.buf) != ch.sum {
+			return n, ErrChunk
+		}
+		if err := c.store.put(ch, c.buf); err != nil {
+			return n, err
+		}
+		c.i, c.buf = c.i+1, nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// prune prunes the store once after the last chunk
+func (c *cdcReader) prune() {
+	if c.pruned {
+		return
+	}
+	c.pruned = true
+	if err := c.store.prune(); err != nil {
+		fmt.Fprintf(os.Stderr, "Pruning the chunk store %s: %s\n", c.store.dir, err)
+	}
+}
+
+// chunkLeft returns the bytes left in the current chunk
+func (c *cdcReader) chunkLeft() int64 {
+	if c.i == len(c.chunks) {
+		return 0
+	}
+	if c.wanted[c.i] {
+		return int64(c.chunks[c.i].size - len(c.buf))
+	}
+	return int64(c.chunks[c.i].size - c.off)
+}
+
+func packBits(v []bool) []byte {
+	b := make([]byte, (len(v)+7)/8)
+	for i, set := range v {
+		if set {
+			b[i/8] |= 1 << (i % 8)
+		}
+	}
+	return b
+}
+
+func unpackBits(b []byte, n int) []bool {
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = b[i/8]&(1<<(i%8)) != 0
+	}
+	return v
+}
@@ -0,0 +1,308 @@
+package rcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func randBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestCdcCut(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want int // 0 when only the bounds are known
+	}{
+		{"empty", nil, 0},
+		{"shorter than min", make([]byte, cdcMin-1), cdcMin - 1},
+		{"min", make([]byte, cdcMin), cdcMin},
+		{"random", randBytes(1, 4*cdcMax), 0},
+		{"random shorter than max", randBytes(2, cdcMax/2), 0},
+		{"zeros", make([]byte, 2*cdcMax), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cdcCut(tt.b)
+			if tt.want != 0 || len(tt.b) <= cdcMin {
+				if got != tt.want {
+					t.Fatalf("cdcCut() = %d, want %d", got, tt.want)
+				}
+				return
+			}
+			max := len(tt.b)
+			if max > cdcMax {
+				max = cdcMax
+			}
+			if got <= cdcMin || got > max {
+				t.Fatalf("cdcCut() = %d, want in (%d, %d]", got, cdcMin, max)
+			}
+			if again := cdcCut(tt.b); again != got {
+				t.Fatalf("cdcCut() = %d then %d", got, again)
+			}
+			// the cut depends only on the bytes before it
+			if ext := cdcCut(append(tt.b[:got:got], 0)); got < max && ext != got {
+				t.Fatalf("cdcCut() = %d after truncating at %d", ext, got)
+			}
+		})
+	}
+}
+
+func TestChunkFile(t *testing.T) {
+	data := randBytes(3, 3*cdcMax+123)
+	name := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		off, n int64
+	}{
+		{"whole", 0, int64(len(data))},
+		{"empty", 0, 0},
+		{"tail", 1000, int64(len(data)) - 1000},
+		{"small", 10, cdcMin / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := chunkFile(name, tt.off, tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := data[tt.off : tt.off+tt.n]
+			for i, c := range chunks {
+				if c.size != cdcCut(b) {
+					t.Fatalf("chunk %d: size %d, want %d", i, c.size, cdcCut(b))
+				}
+				if c.sum != sha256.Sum256(b[:c.size]) {
+					t.Fatalf("chunk %d: wrong sum", i)
+				}
+				b = b[c.size:]
+			}
+			if len(b) != 0 {
+				t.Fatalf("%d bytes left out of the chunks", len(b))
+			}
+		})
+	}
+}
+
+func TestChunksRoundTrip(t *testing.T) {
+	many := make([]cdcChunk, 1000)
+	for i := range many {
+		many[i] = cdcChunk{sha256.Sum256([]byte{byte(i), byte(i >> 8)}), 1 + i*100}
+	}
+	tests := []struct {
+		name   string
+		chunks []cdcChunk
+	}{
+		{"empty", []cdcChunk{}},
+		{"one", []cdcChunk{{sha256.Sum256([]byte("a")), 1}}},
+		{"max size", []cdcChunk{{sha256.Sum256([]byte("b")), cdcMax}, {sha256.Sum256([]byte("c")), cdcMin}}},
+		{"many", many},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := marshalChunks(tt.chunks)
+			if len(b) != len(tt.chunks)*cdcEntrySize {
+				t.Fatalf("marshalChunks() = %d bytes, want %d", len(b), len(tt.chunks)*cdcEntrySize)
+			}
+			got, err := unmarshalChunks(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.chunks) {
+				t.Fatalf("unmarshalChunks() = %v, want %v", got, tt.chunks)
+			}
+		})
+	}
+}
+
+func TestUnmarshalChunksInvalid(t *testing.T) {
+	entry := func(size uint32) []byte {
+		b := make([]byte, cdcEntrySize)
+		binary.BigEndian.PutUint32(b[sha256.Size:], size)
+		return b
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"partial entry", entry(1)[:cdcEntrySize-1]},
+		{"entry and a half", append(entry(1), entry(1)[:10]...)},
+		{"zero size", entry(0)},
+		{"over max", entry(cdcMax + 1)},
+		{"bad second entry", append(entry(1), entry(0)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := unmarshalChunks(tt.b); err != ErrProtocol {
+				t.Fatalf("unmarshalChunks() error = %v, want %v", err, ErrProtocol)
+			}
+		})
+	}
+}
+
+func TestBitsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []bool
+		want []byte
+	}{
+		{"empty", []bool{}, []byte{}},
+		{"one", []bool{true}, []byte{0x01}},
+		{"byte", []bool{true, false, false, false, false, false, false, true}, []byte{0x81}},
+		{"nine", []bool{false, true, false, false, false, false, false, false, true}, []byte{0x02, 0x01}},
+		{"none set", make([]bool, 17), []byte{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := packBits(tt.v)
+			if !bytes.Equal(b, tt.want) {
+				t.Fatalf("packBits() = %x, want %x", b, tt.want)
+			}
+			if got := unpackBits(b, len(tt.v)); !reflect.DeepEqual(got, tt.v) {
+				t.Fatalf("unpackBits() = %v, want %v", got, tt.v)
+			}
+		})
+	}
+}
+
+func TestCdcExchange(t *testing.T) {
+	chunk := func(i int) cdcChunk {
+		return cdcChunk{sha256.Sum256([]byte{byte(i), byte(i >> 8), byte(i >> 16)}), 1 + i%cdcMax}
+	}
+	tests := []struct {
+		name   string
+		n      int
+		stored []int // chunks already in the listener's store
+		repeat []int // chunks that repeat chunk 0
+	}{
+		{"empty", 0, nil, nil},
+		{"one", 1, nil, nil},
+		{"stored", 3, []int{1}, nil},
+		{"batch", cdcBatch, []int{0, cdcBatch - 1}, nil},
+		{"over a batch", 2*cdcBatch + 3, []int{5, cdcBatch, 2 * cdcBatch}, []int{cdcBatch + 1, 2*cdcBatch + 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := make([]cdcChunk, tt.n)
+			want := make([]bool, tt.n)
+			for i := range chunks {
+				chunks[i], want[i] = chunk(i), true
+			}
+			store := &chunkStore{dir: t.TempDir()}
+			for _, i := range tt.stored {
+				if err := store.put(chunks[i], make([]byte, chunks[i].size)); err != nil {
+					t.Fatal(err)
+				}
+				want[i] = false
+			}
+			for _, i := range tt.repeat {
+				chunks[i], want[i] = chunks[0], false
+			}
+
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			pr := &protoReader{rc: b}
+			done := make(chan error, 1)
+			go func() { done <- pr.cdc(b, store) }()
+			pw := &protoWriter{conn: a}
+			if err := pw.cdc(chunks); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pw.chunks.wanted, want) {
+				t.Fatal("the sender's wanted chunks differ")
+			}
+			if len(pr.chunks.chunks) != tt.n || (tt.n > 0 && !reflect.DeepEqual(pr.chunks.chunks, chunks)) {
+				t.Fatal("the listener's chunk list differs")
+			}
+			if len(pr.chunks.wanted) != tt.n || (tt.n > 0 && !reflect.DeepEqual(pr.chunks.wanted, want)) {
+				t.Fatal("the listener's wanted chunks differ")
+			}
+			frames := (tt.n+cdcBatch-1)/cdcBatch + 1
+			if pr.wire != uint64(frames*frameHeaderSize+tt.n*cdcEntrySize) {
+				t.Fatalf("the listener counted %d wire bytes", pr.wire)
+			}
+		})
+	}
+}
+
+func TestChunkStorePrune(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		name  string
+		max   int64
+		old   int // chunks used before the transfer, the first is the least recently used
+		used  int // chunks used by the transfer
+		kept  int // old chunks left, the most recently used ones
+		extra bool
+	}{
+		{"unlimited", 0, 5, 2, 5, false},
+		{"within max", 7 * size, 5, 2, 5, false},
+		{"over max", 4 * size, 5, 2, 2, false},
+		{"used over max", size, 3, 2, 0, false},
+		{"other files", 4 * size, 5, 2, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &chunkStore{dir: t.TempDir(), max: tt.max}
+			chunks := make([]cdcChunk, tt.old+tt.used)
+			for i := range chunks {
+				b := randBytes(int64(i), size)
+				chunks[i] = cdcChunk{sha256.Sum256(b), size}
+				if err := s.put(chunks[i], b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			start := time.Now()
+			for i := 0; i < tt.old; i++ {
+				used := start.Add(time.Duration(i-tt.old-1) * time.Hour)
+				if err := os.Chtimes(s.path(chunks[i].sum), used, used); err != nil {
+					t.Fatal(err)
+				}
+			}
+			other := filepath.Join(s.dir, "notes.txt")
+			if tt.extra {
+				if err := os.WriteFile(other, make([]byte, 10*size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.since = start
+			for _, c := range chunks[tt.old:] {
+				if !s.has(c) {
+					t.Fatal("a stored chunk is missing")
+				}
+			}
+			if err := s.prune(); err != nil {
+				t.Fatal(err)
+			}
+			for i, c := range chunks {
+				want := i >= tt.old-tt.kept
+				if got := s.has(c); got != want {
+					t.Fatalf("chunk %d kept %v, want %v", i, got, want)
+				}
+			}
+			if _, err := os.Stat(other); tt.extra && err != nil {
+				t.Fatal("a file that is not a chunk was removed")
+			}
+			if tmps, _ := filepath.Glob(filepath.Join(s.dir, "*", "*.*")); len(tmps) > 0 {
+				t.Fatalf("temporary files left: %v", tmps)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package rcp
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+type chartPanel struct {
+	title  string
+	color  color.RGBA
+	values []float64
+}
+
+func (rec *Recording) panels() []chartPanel {
+	in := chartPanel{color: color.RGBA{0, 204, 0, 255}}
+	out := chartPanel{color: color.RGBA{204, 0, 0, 255}}
+	buf := chartPanel{color: color.RGBA{204, 204, 0, 255}}
+	prog := chartPanel{color: color.RGBA{0, 204, 204, 255}}
+	var last Metrics
+	for _, m := range rec.Samples {
+		in.values = append(in.values, float64(m.InputByteSec))
+		out.values = append(out.values, float64(m.OutputByteSec))
+		buf.values = append(buf.values, float64(m.BufferUsed))
+		prog.values = append(prog.values, float64(m.Size))
+		last = m
+	}
+	in.title = fmt.Sprintf("Input [%s] (max: %syte/sec)", rec.InputName, humanize.Bytes(last.InputMaxByteSec))
+	out.title = fmt.Sprintf("Output [%s] (max: %syte/sec)", rec.OutputName, humanize.Bytes(last.OutputMaxByteSec))
+	buf.title = fmt.Sprintf("Buffer used (max: %syte)", humanize.Bytes(last.BufferMaxUsed))
+	prog.title = fmt.Sprintf("Progress [%s / %s Byte] in %s, Average speed: %syte/sec",
+		humanize.Comma(int64(last.Size)), humanize.Comma(rec.TotalSize), last.Elapsed, humanize.Bytes(last.AvgByteSec))
+	return []chartPanel{in, out, buf, prog}
+}
+
+// points scales the panel values into the rectangle (x, y, w, h)
+func (p chartPanel) points(x, y, w, h int) []image.Point {
+	max := 1.0
+	for _, v := range p.values {
+		if v > max {
+			max = v
+		}
+	}
+	pts := make([]image.Point, len(p.values))
+	for i, v := range p.values {
+		px := x
+		if len(p.values) > 1 {
+			px = x + i*(w-1)/(len(p.values)-1)
+		}
+		pts[i] = image.Pt(px, y+h-1-int(v/max*float64(h-1)))
+	}
+	return pts
+}
+
+const chartMargin = 20
+
+// WriteSVG writes the recording as an SVG chart
+func (rec *Recording) WriteSVG(w io.Writer, width, height int) error {
+	panels := rec.panels()
+	ph := height / len(panels)
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", width, height)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="black"/>`+"\n", width, height)
+	for i, p := range panels {
+		y := i * ph
+		c := fmt.Sprintf("#%02x%02x%02x", p.color.R, p.color.G, p.color.B)
+		fmt.Fprintf(&b, `<rect x="1" y="%d" width="%d" height="%d" fill="none" stroke="white"/>`+"\n", y+1, width-2, ph-2)
+		fmt.Fprintf(&b, `<text x="6" y="%d" fill="%s">%s</text>`+"\n", y+15, c, html.EscapeString(p.title))
+		var pts []string
+		for _, pt := range p.points(chartMargin/2, y+chartMargin, width-chartMargin, ph-chartMargin-4) {
+			pts = append(pts, fmt.Sprintf("%d,%d", pt.X, pt.Y))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" points="%s"/>`+"\n", c, strings.Join(pts, " "))
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WritePNG writes the recording as a PNG chart
+func (rec *Recording) WritePNG(w io.Writer, width, height int) error {
+	panels := rec.panels()
+	ph := height / len(panels)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	white := color.RGBA{255, 255, 255, 255}
+	for i := range img.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	for i, p := range panels {
+		y := i * ph
+		drawLine(img, image.Pt(1, y+1), image.Pt(width-2, y+1), white)
+		drawLine(img, image.Pt(1, y+ph-2), image.Pt(width-2, y+ph-2), white)
+		drawLine(img, image.Pt(1, y+1), image.Pt(1, y+ph-2), white)
+		drawLine(img, image.Pt(width-2, y+1), image.Pt(width-2, y+ph-2), white)
+		pts := p.points(chartMargin/2, y+chartMargin, width-chartMargin, ph-chartMargin-4)
+		for j := 1; j < len(pts); j++ {
+			drawLine(img, pts[j-1], pts[j], p.color)
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// drawLine draws a line with Bresenham's algorithm
+func drawLine(img *image.RGBA, a, b image.Point, c color.RGBA) {
+	dx, dy := abs(b.X-a.X), -abs(b.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > b.X {
+		sx = -1
+	}
+	if a.Y > b.Y {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.SetRGBA(a.X, a.Y, c)
+		if a == b {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			a.X += sx
+		}
+		if e2 <= dx {
+			e += dx
+			a.Y += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
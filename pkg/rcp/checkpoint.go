@@ -0,0 +1,329 @@
+package rcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCheckpoint error type of --checkpoint without an input file to send from the acknowledged offset
+var ErrCheckpoint = errors.New("The --checkpoint mode needs an input file and cannot be combined with --delta or --cdc")
+
+// ErrResume error type of a transfer that cannot continue from the checkpoint
+var ErrResume = errors.New("The transfer cannot be resumed from the checkpoint")
+
+// checkpoint what the listener acknowledged of a transfer, journaled on both sides
+type checkpoint struct {
+	Session      string `json:"session"`
+	Name         string `json:"name"`           // the input of the sender, the output of the listener
+	File         string `json:"file,omitempty"` // the incomplete output of the listener
+	Start        int64  `json:"start"`          // offset of the transfer in Name or File
+	Size         int64  `json:"size"`           // bytes of the whole transfer, 0 if not known
+	Acknowledged int64  `json:"acknowledged"`   // bytes from Start durably written by the listener
+}
+
+// loadCheckpoint reads the checkpoint in path, nil if there is none
+func loadCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// journal keeps the checkpoint of the transfer in its file
+type journal struct {
+	mu   sync.Mutex
+	path string
+	ckpt checkpoint
+	base int64 // bytes of the transfer acknowledged before the stream started
+}
+
+// ack records that the listener made the first n bytes of the stream durable
+func (j *journal) ack(n int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.base+n <= j.ckpt.Acknowledged {
+		return
+	}
+	j.ckpt.Acknowledged = j.base + n
+	if err := j.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "checkpoint: %s\n", err)
+	}
+}
+
+// keep records the name of the incomplete output and the n bytes of the stream it holds
+func (j *journal) keep(name string, n int64) {
+	j.mu.Lock()
+	j.ckpt.File = name
+	j.mu.Unlock()
+	j.ack(n)
+}
+
+// save replaces the file so that a crash leaves either the previous or the new checkpoint
+func (j *journal) save() error {
+	b, err := json.Marshal(j.ckpt)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// remove drops the checkpoint of a finished transfer
+func (j *journal) remove() {
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "checkpoint: %s\n", err)
+	}
+}
+
+// acker acknowledges the bytes of the output made durable by each sync,
+// to the sender that asked for it and in the journal
+type acker struct {
+	pr      *protoReader
+	journal *journal // nil without --checkpoint
+	written *prefix
+	staged  int64 // bytes the fileWriter may hold before writing them with O_DIRECT
+	align   int64
+}
+
+// durable returns the bytes of the output that the next sync makes durable
+func (a *acker) durable() int64 {
+	n := a.written.len() - a.staged
+	if n < 0 {
+		return 0
+	}
+	return n &^ (a.align - 1)
+}
+
+// ack acknowledges the first n bytes of the output
+func (a *acker) ack(n int64) {
+	n += a.pr.start
+	if a.journal != nil {
+		a.journal.ack(n)
+	}
+	if a.pr.header.Ack {
+		a.pr.ack(n)
+	}
+}
+
+// done acknowledges the complete output and drops the journal
+func (a *acker) done() {
+	if a.pr.header.Ack {
+		a.pr.ack(a.pr.start + a.written.len())
+	}
+	if a.journal != nil {
+		a.journal.remove()
+	}
+}
+
+// keep journals the incomplete output name, synced up to its first n bytes
+func (a *acker) keep(name string, n int64) {
+	if a.journal != nil {
+		a.journal.keep(name, a.pr.start+(n&^(a.align-1)))
+	}
+}
+
+// drop removes the journal of a failed output
+func (a *acker) drop() {
+	if a.journal != nil {
+		a.journal.remove()
+	}
+}
+
+// newAcker prepares the acknowledgments of the listener, and answers a sender resuming a transfer
+func (rcp *Rcp) newAcker(pr *protoReader, conn net.Conn) error {
+	a := &acker{pr: pr, written: rcp.written, align: 1}
+	if rcp.Direct {
+		a.staged, a.align = int64(rcp.BufSize), blockAlign
+	}
+	var ckpt *checkpoint
+	if len(rcp.Checkpoint) > 0 {
+		a.journal = &journal{path: rcp.Checkpoint}
+		a.journal.ckpt = checkpoint{Session: pr.header.Session, Name: rcp.Output, Size: pr.header.Size}
+		var err error
+		if ckpt, err = loadCheckpoint(rcp.Checkpoint); err != nil {
+			return err
+		}
+	}
+	if pr.header.Resume {
+		if err := rcp.restart(pr, conn, ckpt); err != nil {
+			return err
+		}
+		a.journal.ckpt, a.journal.base = *ckpt, pr.header.Acknowledged
+	}
+	rcp.ack = a
+	return nil
+}
+
+// restart answers a sender resuming the transfer of ckpt with the offset of its stream to send from,
+// and continues the output where the checkpoint ends
+func (rcp *Rcp) restart(pr *protoReader, conn net.Conn, ckpt *checkpoint) error {
+	h := pr.header
+	ok := ckpt != nil && ckpt.Session == h.Session && ckpt.Name == rcp.Output && ckpt.Acknowledged >= h.Acknowledged
+	if ok {
+		_, err := os.Stat(ckpt.File)
+		ok = err == nil
+	}
+	if !ok {
+		writeMessage(conn, frameResume, putOffset(-1))
+		return fmt.Errorf("%w: no checkpoint of session %s for %s", ErrResume, h.Session, rcp.Output)
+	}
+	// the sender cannot skip ahead of what it already sent, the listener writes the bytes it has again
+	skip := ckpt.Acknowledged - h.Acknowledged
+	if skip > h.Sent {
+		skip = h.Sent
+	}
+	if err := writeMessage(conn, frameResume, putOffset(skip)); err != nil {
+		return err
+	}
+	pr.start, pr.delivered = skip, skip
+	rcp.resumeFile, rcp.Seek = ckpt.File, ckpt.Start+h.Acknowledged+skip
+	if rcp.TotalSize > 0 {
+		rcp.TotalSize -= skip
+	}
+	return nil
+}
+
+// openJournal loads the checkpoint of the sender, and continues the transfer it describes
+func (rcp *Rcp) openJournal() error {
+	if len(rcp.Input) == 0 || rcp.Delta || rcp.CDC {
+		return ErrCheckpoint
+	}
+	ckpt, err := loadCheckpoint(rcp.Checkpoint)
+	if err != nil {
+		return err
+	}
+	j := &journal{path: rcp.Checkpoint}
+	if ckpt == nil {
+		j.ckpt = checkpoint{Session: newSession(), Name: rcp.Input, Start: rcp.Offset}
+		rcp.journal = j
+		return nil
+	}
+	if ckpt.Name != rcp.Input {
+		return fmt.Errorf("%w: %s is the checkpoint of %s", ErrResume, rcp.Checkpoint, ckpt.Name)
+	}
+	j.ckpt, j.base = *ckpt, ckpt.Acknowledged
+	rcp.Offset = ckpt.Start + ckpt.Acknowledged
+	if ckpt.Size > 0 {
+		rcp.Length = ckpt.Size - ckpt.Acknowledged
+	}
+	rcp.journal, rcp.restarted = j, true
+	return nil
+}
+
+// acknowledger reports the bytes the listener acknowledged as durable
+type acknowledger interface {
+	acknowledged() int64
+}
+
+// ackStream what the listener sends back on a connection of the sender
+type ackStream struct {
+	done chan struct{}
+	err  error // ErrPeerAborted or the error that ended the stream, set before done is closed
+}
+
+// readAcks reads the acknowledgments of the listener on conn until it fails
+func (pw *protoWriter) readAcks(conn net.Conn) *ackStream {
+	s := &ackStream{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		for {
+			typ, n, err := readCount(conn)
+			if err != nil {
+				s.err = err
+				return
+			}
+			switch typ {
+			case frameAck:
+				for old := atomic.LoadInt64(&pw.acked); n > old; old = atomic.LoadInt64(&pw.acked) {
+					if atomic.CompareAndSwapInt64(&pw.acked, old, n) {
+						if pw.journal != nil {
+							pw.journal.ack(n)
+						}
+						break
+					}
+				}
+				select {
+				case pw.ackc <- struct{}{}:
+				default:
+				}
+			case frameAbort:
+				s.err = ErrPeerAborted
+				return
+			case frameEnd:
+				// the confirmation of the end frame, the last acknowledgment follows
+			default:
+				s.err = ErrProtocol
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// startAcks reads the acknowledgments of the listener and journals them in j
+func (pw *protoWriter) startAcks(j *journal) {
+	pw.journal, pw.ackc = j, make(chan struct{}, 1)
+	pw.acks = pw.readAcks(pw.conn)
+}
+
+func (pw *protoWriter) acknowledged() int64 { return atomic.LoadInt64(&pw.acked) }
+
+// waitAcked waits for the listener to acknowledge everything sent
+func (pw *protoWriter) waitAcked() error {
+	s := pw.acks
+	for atomic.LoadInt64(&pw.acked) < pw.sent {
+		select {
+		case <-pw.ackc:
+		case <-s.done:
+			if acked := atomic.LoadInt64(&pw.acked); acked < pw.sent {
+				if s.err == ErrPeerAborted {
+					return s.err
+				}
+				return fmt.Errorf("%w: the listener acknowledged %d of %d bytes", ErrShortTransfer, acked, pw.sent)
+			}
+		}
+	}
+	return nil
+}
+
+// ack tells the sender that the first n bytes of the stream are durable
+func (pr *protoReader) ack(n int64) {
+	rs, ok := pr.rc.(*reciveStream)
+	if !ok {
+		return
+	}
+	rs.mu.Lock()
+	conn := rs.conn
+	rs.mu.Unlock()
+	writeCount(conn, frameAck, n)
+}
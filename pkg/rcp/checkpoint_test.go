@@ -0,0 +1,231 @@
+package rcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	tests := []struct {
+		name string
+		base int64
+		acks []int64
+		want int64
+	}{
+		{"kept only", 0, nil, 1},
+		{"in order", 0, []int64{10, 20, 30}, 30},
+		{"late ack", 0, []int64{30, 20}, 30},
+		{"after a restart", 100, []int64{5, 50}, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ckpt")
+			j := &journal{path: path, base: tt.base}
+			j.ckpt = checkpoint{Session: "s", Name: "in", Start: 7, Size: 1000, Acknowledged: tt.base}
+			if err := j.save(); err != nil {
+				t.Fatal(err)
+			}
+			j.keep("out.part", 1)
+			for _, n := range tt.acks {
+				j.ack(n)
+			}
+			got, err := loadCheckpoint(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := j.ckpt
+			want.File, want.Acknowledged = "out.part", tt.want
+			if *got != want {
+				t.Fatalf("loadCheckpoint() = %+v, want %+v", *got, want)
+			}
+			if tmp, _ := filepath.Glob(path + ".*"); len(tmp) > 0 {
+				t.Fatalf("temporary files left: %v", tmp)
+			}
+			j.remove()
+			if got, err = loadCheckpoint(path); got != nil || err != nil {
+				t.Fatalf("loadCheckpoint() after remove = %v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestOpenJournal(t *testing.T) {
+	tests := []struct {
+		name       string
+		ckpt       *checkpoint
+		input      string
+		wantOffset int64
+		wantLength int64
+		restarted  bool
+		err        error
+	}{
+		{"no checkpoint", nil, "in", 5, 0, false, nil},
+		{"continue", &checkpoint{Session: "s", Name: "in", Start: 5, Size: 100, Acknowledged: 40}, "in", 45, 60, true, nil},
+		{"size not known", &checkpoint{Session: "s", Name: "in", Start: 0, Acknowledged: 40}, "in", 40, 0, true, nil},
+		{"other input", &checkpoint{Session: "s", Name: "other", Acknowledged: 40}, "in", 5, 0, false, ErrResume},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ckpt")
+			if tt.ckpt != nil {
+				j := &journal{path: path, ckpt: *tt.ckpt}
+				if err := j.save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rcp := &Rcp{Input: tt.input, Checkpoint: path, Offset: 5}
+			if err := rcp.openJournal(); !errors.Is(err, tt.err) {
+				t.Fatalf("openJournal() error = %v, want %v", err, tt.err)
+			}
+			if rcp.Offset != tt.wantOffset || rcp.Length != tt.wantLength || rcp.restarted != tt.restarted {
+				t.Fatalf("offset %d, length %d, restarted %v, want %d, %d, %v",
+					rcp.Offset, rcp.Length, rcp.restarted, tt.wantOffset, tt.wantLength, tt.restarted)
+			}
+			if tt.err == nil && len(rcp.journal.ckpt.Session) == 0 {
+				t.Fatal("the journal has no session")
+			}
+		})
+	}
+	if err := (&Rcp{Input: "in", Checkpoint: "ckpt", CDC: true}).openJournal(); err != ErrCheckpoint {
+		t.Fatalf("openJournal() with --cdc error = %v, want %v", err, ErrCheckpoint)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	dir := t.TempDir()
+	part := filepath.Join(dir, "out.part")
+	if err := os.WriteFile(part, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ckpt := &checkpoint{Session: "s", Name: "out", File: part, Start: 10, Size: 1000, Acknowledged: 100}
+	tests := []struct {
+		name     string
+		ckpt     *checkpoint
+		h        header // of the restarted sender
+		want     int64  // the offset of the stream the sender sends from
+		wantSeek int64
+		err      error
+	}{
+		{"sender from the checkpoint", ckpt, header{Session: "s", Acknowledged: 100, Sent: 500}, 0, 110, nil},
+		{"sender behind", ckpt, header{Session: "s", Acknowledged: 60, Sent: 500}, 40, 110, nil},
+		{"sender sent less", ckpt, header{Session: "s", Acknowledged: 60, Sent: 10}, 10, 80, nil},
+		{"no checkpoint", nil, header{Session: "s", Acknowledged: 100}, -1, 0, ErrResume},
+		{"other session", ckpt, header{Session: "t", Acknowledged: 100}, -1, 0, ErrResume},
+		{"sender ahead", ckpt, header{Session: "s", Acknowledged: 200}, -1, 0, ErrResume},
+		{"file removed", &checkpoint{Session: "s", Name: "out", File: part + ".gone", Acknowledged: 100},
+			header{Session: "s", Acknowledged: 100}, -1, 0, ErrResume},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			answer := make(chan int64, 1)
+			go func() {
+				defer b.Close()
+				m, err := readMessage(b, frameResume)
+				if err != nil {
+					answer <- -2
+					return
+				}
+				n, _ := getOffset(m)
+				answer <- n
+			}()
+			rcp := &Rcp{Output: "out", SpeedDashboard: newHeadlessDashboard()}
+			rcp.TotalSize = 1000
+			tt.h.Resume = true
+			pr := &protoReader{header: tt.h}
+			if err := rcp.restart(pr, a, tt.ckpt); !errors.Is(err, tt.err) {
+				t.Fatalf("restart() error = %v, want %v", err, tt.err)
+			}
+			if got := <-answer; got != tt.want {
+				t.Fatalf("the listener answered %d, want %d", got, tt.want)
+			}
+			if tt.err != nil {
+				return
+			}
+			if rcp.Seek != tt.wantSeek || rcp.resumeFile != part || pr.start != tt.want || rcp.TotalSize != 1000-tt.want {
+				t.Fatalf("seek %d of %s, start %d, size %d", rcp.Seek, rcp.resumeFile, pr.start, rcp.TotalSize)
+			}
+		})
+	}
+}
+
+func TestAckStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		acks    []int64
+		abort   bool
+		sent    int64
+		want    int64
+		waitErr error
+	}{
+		{"all", []int64{10, 20, 30}, false, 30, 30, nil},
+		{"out of order", []int64{20, 10, 30}, false, 30, 30, nil},
+		{"short", []int64{10}, false, 30, 10, ErrShortTransfer},
+		{"abort", []int64{10}, true, 30, 10, ErrPeerAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ckpt")
+			j := &journal{path: path, base: 100, ckpt: checkpoint{Session: "s", Name: "in", Acknowledged: 100}}
+			a, b := net.Pipe()
+			pw := &protoWriter{conn: a, sent: tt.sent}
+			pw.startAcks(j)
+			pr := &protoReader{rc: &reciveStream{conn: b, closed: make(chan struct{})}}
+			go func() {
+				for _, n := range tt.acks {
+					pr.ack(n)
+				}
+				if tt.abort {
+					writeCount(b, frameAbort, 0)
+				}
+				b.Close()
+			}()
+			err := pw.waitAcked()
+			if !errors.Is(err, tt.waitErr) {
+				t.Fatalf("waitAcked() error = %v, want %v", err, tt.waitErr)
+			}
+			if tt.waitErr == nil {
+				// the sender stops waiting once it has the last acknowledgment
+				<-pw.acks.done
+			}
+			a.Close()
+			if got := atomic.LoadInt64(&pw.acked); got != tt.want {
+				t.Fatalf("acknowledged %d, want %d", got, tt.want)
+			}
+			ckpt, err := loadCheckpoint(path)
+			if err != nil || ckpt == nil {
+				t.Fatalf("loadCheckpoint() = %v, %v", ckpt, err)
+			}
+			if ckpt.Acknowledged != 100+tt.want {
+				t.Fatalf("journaled %d, want %d", ckpt.Acknowledged, 100+tt.want)
+			}
+		})
+	}
+}
+
+func TestAckerDurable(t *testing.T) {
+	tests := []struct {
+		name          string
+		written       int64
+		staged, align int64
+		want          int64
+	}{
+		{"buffered", 12345, 0, 1, 12345},
+		{"direct", 3*blockAlign + 10, 0, blockAlign, 3 * blockAlign},
+		{"staged", 10 * blockAlign, 4 * blockAlign, blockAlign, 6 * blockAlign},
+		{"all staged", 2 * blockAlign, 4 * blockAlign, blockAlign, 0},
+	}
+	for _, tt := range tests {
+		p := newPrefix()
+		p.add(0, tt.written)
+		a := &acker{written: p, staged: tt.staged, align: tt.align}
+		if got := a.durable(); got != tt.want {
+			t.Errorf("%s: durable() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -48,6 +48,7 @@ type SpeedDashboard struct {
 	OutputName   string
 	ProgressSize int
 	TotalSize    int64
+	Interval     time.Duration
 
 	Title    *widgets.Paragraph
 	Output   *widgets.Sparkline
@@ -70,17 +71,71 @@ type Metrics struct {
 	OutputMaxByteSec uint64
 	BufferUsed       uint64
 	BufferMaxUsed    uint64
+	BufferLimit      uint64
+	Elapsed          time.Duration
+	WindowByteSec    uint64
+	EWMAByteSec      uint64
+	ETA              time.Duration
+	MinByteSec       uint64
+	P50ByteSec       uint64
+	P95ByteSec       uint64
+	SkippedBytes     uint64
+	WireBytes        uint64
+	WireByteSec      uint64
+	Reconnects       uint64
+	Downtime         time.Duration
+	Acknowledged     uint64
 }
 
 func (s *SpeedDashboard) updateTitle() {
-	s.Progress.Title = fmt.Sprintf("Progress:[%s / %s Byte], Average speed:[%syte/sec]",
-		humanize.Comma(int64(s.Size)), humanize.Comma(s.TotalSize), humanize.Bytes(s.AvgByteSec))
+	s.Progress.Title = fmt.Sprintf("Progress:[%s / %s Byte], Average speed:[%syte/sec], Elapsed:[%s], ETA:[%s]",
+		humanize.Comma(int64(s.Size)), humanize.Comma(s.TotalSize), humanize.Bytes(s.AvgByteSec),
+		s.Elapsed.Round(time.Second), s.etaString())
+	if s.Acknowledged > 0 {
+		s.Progress.Title += fmt.Sprintf(", Acknowledged:[%s Byte]", humanize.Comma(int64(s.Acknowledged)))
+	}
+	if s.SkippedBytes > 0 {
+		s.Progress.Title += fmt.Sprintf(", Skipped holes:[%s Byte]", humanize.Comma(int64(s.SkippedBytes)))
+	}
+	if s.WireBytes > 0 {
+		s.Progress.Title += fmt.Sprintf(", Real:[%s Byte on the wire, %syte/sec]", humanize.Comma(int64(s.WireBytes)), humanize.Bytes(s.WireByteSec))
+	}
+	if s.Reconnects > 0 {
+		s.Progress.Title += fmt.Sprintf(", Reconnects:[%d, down %s]", s.Reconnects, s.Downtime.Round(time.Millisecond))
+	}
 	s.Input.Title = fmt.Sprintf("Input [%s] %syte/sec (max: %syte/sec)",
 		s.InputName, humanize.Bytes(s.InputByteSec), humanize.Bytes(s.InputMaxByteSec))
-	s.Output.Title = fmt.Sprintf("Output [%s] %syte/sec (max: %syte/sec)",
-		s.OutputName, humanize.Bytes(s.OutputByteSec), humanize.Bytes(s.OutputMaxByteSec))
+	s.Output.Title = fmt.Sprintf("Output [%s] %syte/sec (max: %syte/sec, moving avg: %syte/sec, ewma: %syte/sec)",
+		s.OutputName, humanize.Bytes(s.OutputByteSec), humanize.Bytes(s.OutputMaxByteSec),
+		humanize.Bytes(s.WindowByteSec), humanize.Bytes(s.EWMAByteSec))
 	s.Buffer.Title = fmt.Sprintf("Buffer used: %syte (max: %syte)",
 		humanize.Bytes(s.BufferUsed), humanize.Bytes(s.BufferMaxUsed))
+	if s.BufferLimit > 0 {
+		s.Buffer.Title += fmt.Sprintf(", Adaptive limit:[%syte]", humanize.Bytes(s.BufferLimit))
+	}
+}
+
+func (s *SpeedDashboard) etaString() string {
+	switch {
+	case s.TotalSize > 0 && int64(s.Size) >= s.TotalSize:
+		return "0s"
+	case s.ETA > 0:
+		return s.ETA.Round(time.Second).String()
+	}
+	return "unknown"
+}
+
+// Summary returns the lines printed after the transfer
+func (s *SpeedDashboard) Summary() []string {
+	s.updateTitle()
+	return []string{
+		s.Input.Title,
+		s.Output.Title,
+		s.Buffer.Title,
+		s.Progress.Title,
+		fmt.Sprintf("Output speed: min %syte/sec, p50 %syte/sec, p95 %syte/sec",
+			humanize.Bytes(s.MinByteSec), humanize.Bytes(s.P50ByteSec), humanize.Bytes(s.P95ByteSec)),
+	}
 }
 
 func percent(total int64, curr uint64) int {
@@ -103,6 +158,7 @@ func NewSpeedDashboard() *SpeedDashboard {
 	s := &SpeedDashboard{
 		UIIface:      tu,
 		ProgressSize: 3,
+		Interval:     time.Second,
 		Title:        widgets.NewParagraph(),
 		Output:       widgets.NewSparkline(),
 		Input:        widgets.NewSparkline(),
@@ -137,6 +193,13 @@ func NewSpeedDashboard() *SpeedDashboard {
 	return s
 }
 
+// newHeadlessDashboard returns a SpeedDashboard that is never shown, for the metrics and Summary
+func newHeadlessDashboard() *SpeedDashboard {
+	s := NewSpeedDashboard()
+	s.Ch = nil // nobody receives the samples
+	return s
+}
+
 func (s *SpeedDashboard) resize() {
 	speedY := 1
 	tw, th := s.TerminalDimensions()
@@ -170,7 +233,7 @@ func (s *SpeedDashboard) Run(ctx context.Context) error {
 	defer s.Close()
 
 	uiEvents := s.PollEvents()
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(s.Interval)
 	defer ticker.Stop()
 	for {
 		select {
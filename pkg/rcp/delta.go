@@ -0,0 +1,267 @@
+package rcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+const (
+	minDeltaBlock = 2 * 1024
+	maxDeltaBlock = 1024 * 1024
+	sigSize       = 4 + 16
+	sigHeaderSize = 4 + 8
+)
+
+// signatures block checksums of the listener's existing output
+type signatures struct {
+	blockSize int
+	size      int64
+	weak      []uint32
+	strong    [][16]byte
+	index     map[uint32][]int // weak checksum -> full blocks
+	tags      []uint64         // bitset of tag(weak) of the blocks in index
+}
+
+// deltaBlockSize returns about the square root of size, like rsync
+func deltaBlockSize(size int64) int {
+	b := minDeltaBlock
+	for b < maxDeltaBlock && int64(b)*int64(b) < size {
+		b *= 2
+	}
+	return b
+}
+
+// rollsum rsync's rolling checksum of b
+func rollsum(b []byte) (a, s uint32) {
+	for i, v := range b {
+		a += uint32(v)
+		s += uint32(len(b)-i) * uint32(v)
+	}
+	return
+}
+
+func weakSum(a, s uint32) uint32 { return a&0xffff | s<<16 }
+
+func strongSum(b []byte) (sum [16]byte) {
+	h := sha256.Sum256(b)
+	copy(sum[:], h[:])
+	return
+}
+
+// readSignatures computes the signatures of f, which has size bytes
+func readSignatures(f *os.File, size int64) (*signatures, error) {
+	sigs := &signatures{blockSize: deltaBlockSize(size), size: size}
+	buf := make([]byte, sigs.blockSize)
+	r := io.NewSectionReader(f, 0, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			a, s := rollsum(buf[:n])
+			sigs.weak = append(sigs.weak, weakSum(a, s))
+			sigs.strong = append(sigs.strong, strongSum(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sigs.buildIndex()
+	return sigs, nil
+}
+
+func (sigs *signatures) buildIndex() {
+	sigs.index = map[uint32][]int{}
+	sigs.tags = make([]uint64, 1<<20/64)
+	for i, w := range sigs.weak {
+		if sigs.blockLen(i) == sigs.blockSize {
+			sigs.index[w] = append(sigs.index[w], i)
+			t := tag(w)
+			sigs.tags[t/64] |= 1 << (t % 64)
+		}
+	}
+}
+
+// blockLen returns the length of block i, the last one may be short
+func (sigs *signatures) blockLen(i int) int {
+	if rest := sigs.size - int64(i)*int64(sigs.blockSize); rest < int64(sigs.blockSize) {
+		return int(rest)
+	}
+	return sigs.blockSize
+}
+
+// tag hashes a weak checksum into 20 bits for a quick miss before the index lookup
+func tag(weak uint32) uint32 { return weak * 0x9e3779b1 >> 12 }
+
+// find returns the full block matching win
+func (sigs *signatures) find(weak uint32, win []byte) (int, bool) {
+	if t := tag(weak); sigs.tags[t/64]&(1<<(t%64)) == 0 {
+		return 0, false
+	}
+	blocks, ok := sigs.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(win)
+	for _, i := range blocks {
+		if sigs.strong[i] == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (sigs *signatures) marshal() []byte {
+	b := make([]byte, sigHeaderSize, sigHeaderSize+len(sigs.weak)*sigSize)
+	binary.BigEndian.PutUint32(b, uint32(sigs.blockSize))
+	binary.BigEndian.PutUint64(b[4:], uint64(sigs.size))
+	for i, w := range sigs.weak {
+		var weak [4]byte
+		binary.BigEndian.PutUint32(weak[:], w)
+		b = append(append(b, weak[:]...), sigs.strong[i][:]...)
+	}
+	return b
+}
+
+func unmarshalSignatures(b []byte) (*signatures, error) {
+	if len(b) < sigHeaderSize {
+		return nil, ErrProtocol
+	}
+	sigs := &signatures{
+		blockSize: int(binary.BigEndian.Uint32(b)),
+		size:      int64(binary.BigEndian.Uint64(b[4:])),
+	}
+	b = b[sigHeaderSize:]
+	if sigs.blockSize < minDeltaBlock || sigs.blockSize > maxDeltaBlock || len(b)%sigSize != 0 ||
+		int64(len(b)/sigSize) != (sigs.size+int64(sigs.blockSize)-1)/int64(sigs.blockSize) {
+		return nil, ErrProtocol
+	}
+	for ; len(b) > 0; b = b[sigSize:] {
+		sigs.weak = append(sigs.weak, binary.BigEndian.Uint32(b))
+		var strong [16]byte
+		copy(strong[:], b[4:sigSize])
+		sigs.strong = append(sigs.strong, strong)
+	}
+	sigs.buildIndex()
+	return sigs, nil
+}
+
+// maxLiteral bytes kept back while looking for a matching block
+const maxLiteral = 4 * maxDeltaBlock
+
+// deltaWriter sends literal data and references to the blocks the listener already has
+type deltaWriter struct {
+	sigs    *signatures
+	pw      *protoWriter
+	buf     []byte // bytes not sent yet
+	i       int    // start of the window in buf
+	a, s    uint32 // rolling checksum of the window
+	rolling bool
+}
+
+func (d *deltaWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	return len(p), d.match()
+}
+
+func (d *deltaWriter) match() error {
+	bs := d.sigs.blockSize
+	for d.i+bs <= len(d.buf) {
+		win := d.buf[d.i : d.i+bs]
+		if !d.rolling {
+			d.a, d.s = rollsum(win)
+			d.rolling = true
+		}
+		if idx, ok := d.sigs.find(weakSum(d.a, d.s), win); ok {
+			if err := d.literal(d.i); err != nil {
+				return err
+			}
+			if err := d.pw.writeFrame(frameCopy, int64(idx)); err != nil {
+				return err
+			}
+			d.buf = d.buf[bs:]
+			d.rolling = false
+			continue
+		}
+		if d.i+bs == len(d.buf) {
+			break // roll on with the next write
+		}
+		out, in := uint32(d.buf[d.i]), uint32(d.buf[d.i+bs])
+		d.a = d.a - out + in
+		d.s = d.s - uint32(bs)*out + d.a
+		d.i++
+		if d.i >= maxLiteral {
+			if err := d.literal(d.i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// literal sends the first n bytes of buf as data
+func (d *deltaWriter) literal(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if _, err := d.pw.writeData(d.buf[:n]); err != nil {
+		return err
+	}
+	d.buf = d.buf[n:]
+	d.i -= n
+	return nil
+}
+
+// flush sends what is left, matching the short last block of the listener's file
+func (d *deltaWriter) flush() error {
+	if last := len(d.sigs.weak) - 1; last >= 0 {
+		if n := d.sigs.blockLen(last); n < d.sigs.blockSize && len(d.buf) >= n {
+			tail := d.buf[len(d.buf)-n:]
+			if a, s := rollsum(tail); weakSum(a, s) == d.sigs.weak[last] && strongSum(tail) == d.sigs.strong[last] {
+				if err := d.literal(len(d.buf) - n); err != nil {
+					return err
+				}
+				d.buf = d.buf[:0]
+				d.i, d.rolling = 0, false
+				return d.pw.writeFrame(frameCopy, int64(last))
+			}
+		}
+	}
+	err := d.literal(len(d.buf))
+	d.i, d.rolling = 0, false
+	return err
+}
+
+// sendSignatures answers a delta request with the signatures of the existing output
+func sendSignatures(w io.Writer, name string) (base *os.File, sigs *signatures, err error) {
+	sigs = &signatures{blockSize: minDeltaBlock}
+	if f, oerr := os.Open(name); oerr == nil {
+		fi, serr := f.Stat()
+		if serr == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+			if sigs, err = readSignatures(f, fi.Size()); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			base = f
+		} else {
+			f.Close()
+		}
+	}
+	if err = writeMessage(w, frameSignatures, sigs.marshal()); err != nil && base != nil {
+		base.Close()
+		base = nil
+	}
+	return base, sigs, err
+}
+
+// recvSignatures reads the answer to a delta request
+func recvSignatures(r io.Reader) (*signatures, error) {
+	b, err := readMessage(r, frameSignatures)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSignatures(b)
+}
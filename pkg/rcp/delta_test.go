@@ -0,0 +1,184 @@
+package rcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRollsum(t *testing.T) {
+	b := randBytes(5, 10000)
+	tests := []struct {
+		name string
+		bs   int
+	}{
+		{"one byte", 1},
+		{"min block", minDeltaBlock},
+		{"odd block", 1237},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, s := rollsum(b[:tt.bs])
+			for i := 0; i+tt.bs < len(b); i++ {
+				// the update of deltaWriter.match
+				out, in := uint32(b[i]), uint32(b[i+tt.bs])
+				a = a - out + in
+				s = s - uint32(tt.bs)*out + a
+				if wa, ws := rollsum(b[i+1 : i+1+tt.bs]); wa != a || ws != s {
+					t.Fatalf("rolled to %d: %d %d, want %d %d", i+1, a, s, wa, ws)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minDeltaBlock},
+		{1 << 20, minDeltaBlock},
+		{1 << 24, 4096},
+		{1 << 30, 32768},
+		{1 << 50, maxDeltaBlock},
+	}
+	for _, tt := range tests {
+		if got := deltaBlockSize(tt.size); got != tt.want {
+			t.Errorf("deltaBlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestSignaturesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"short block", 100},
+		{"full blocks", 4 * minDeltaBlock},
+		{"short last block", 4*minDeltaBlock + 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "base")
+			if err := os.WriteFile(name, randBytes(6, tt.size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			sigs, err := readSignatures(f, int64(tt.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := unmarshalSignatures(sigs.marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.blockSize != sigs.blockSize || got.size != sigs.size ||
+				!reflect.DeepEqual(got.weak, sigs.weak) || !reflect.DeepEqual(got.strong, sigs.strong) {
+				t.Fatal("the signatures differ after a round trip")
+			}
+		})
+	}
+	valid := (&signatures{blockSize: minDeltaBlock, size: 10, weak: []uint32{1}, strong: [][16]byte{{}}}).marshal()
+	invalid := map[string][]byte{
+		"short":           valid[:sigHeaderSize-1],
+		"partial entry":   valid[:len(valid)-1],
+		"missing entry":   valid[:sigHeaderSize],
+		"extra entry":     append(append([]byte{}, valid...), valid[sigHeaderSize:]...),
+		"small blockSize": append([]byte{0, 0, 0, 1}, valid[4:]...),
+	}
+	for name, b := range invalid {
+		if _, err := unmarshalSignatures(b); err != ErrProtocol {
+			t.Errorf("%s: unmarshalSignatures() error = %v, want %v", name, err, ErrProtocol)
+		}
+	}
+}
+
+func TestDeltaTransfer(t *testing.T) {
+	const size = 1 << 20
+	base := randBytes(7, size)
+	modified := append([]byte{}, base...)
+	copy(modified[size/2:], "changed in the middle")
+	tests := []struct {
+		name    string
+		base    []byte
+		input   []byte
+		maxWire int // bytes of the data frames and the frame headers
+	}{
+		{"no base", nil, base, size + size/100},
+		{"identical", base, base, size / 50},
+		{"modified", base, modified, size / 50},
+		{"shifted", base, append([]byte("inserted before"), base...), size / 50},
+		{"appended", base, append(append([]byte{}, base...), "appended"...), size / 50},
+		{"truncated", base, base[:size-1000], size / 50},
+		{"unrelated", base, randBytes(8, size), size + size/100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "output")
+			if tt.base != nil {
+				if err := os.WriteFile(name, tt.base, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a, b := net.Pipe()
+			defer b.Close()
+			sent := make(chan error, 1)
+			go func() {
+				pw, err := newProtoWriter(a, header{Size: int64(len(tt.input)), Delta: true})
+				if err != nil {
+					a.Close()
+					sent <- err
+					return
+				}
+				// odd writes so that blocks span them
+				for in := tt.input; len(in) > 0; {
+					n := 7001
+					if n > len(in) {
+						n = len(in)
+					}
+					if _, err = pw.Write(in[:n]); err != nil {
+						a.Close()
+						sent <- err
+						return
+					}
+					in = in[n:]
+				}
+				sent <- pw.Close()
+			}()
+			pr, err := newProtoReader(&reciveStream{conn: b, closed: make(chan struct{})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = pr.delta(b, name); err != nil {
+				t.Fatal(err)
+			}
+			if pr.base != nil {
+				defer pr.base.Close()
+			}
+			got, err := io.ReadAll(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.input) {
+				t.Fatalf("read %d bytes that differ from the %d of the input", len(got), len(tt.input))
+			}
+			if wire := int(pr.wireBytes()); wire > tt.maxWire {
+				t.Fatalf("%d bytes on the wire, want at most %d", wire, tt.maxWire)
+			}
+		})
+	}
+}
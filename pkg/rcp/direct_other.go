@@ -0,0 +1,16 @@
+//go:build !linux
+
+package rcp
+
+import (
+	"errors"
+	"os"
+)
+
+var errDirectUnsupported = errors.New("direct I/O is only supported on Linux")
+
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, errDirectUnsupported
+}
+
+func clearDirect(f *os.File) error { return nil }
@@ -0,0 +1,52 @@
+package rcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// TransferError an error of a transfer with its Kind, one of ErrConnection,
+// ErrChecksum, ErrDiskFull or ErrShortTransfer; errors.Is matches both Kind and Err
+type TransferError struct {
+	Kind error
+	Err  error
+}
+
+func (e *TransferError) Error() string { return fmt.Sprintf("%s: %s", e.Kind, e.Err) }
+
+// Unwrap returns the underlying error
+func (e *TransferError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e
+func (e *TransferError) Is(target error) bool { return target == e.Kind }
+
+// classify gives err the kind of failure it stands for
+func classify(err error) error {
+	var te *TransferError
+	var partial *PartialError
+	var opErr *net.OpError
+	var kind error
+	switch {
+	case err == nil || errors.As(err, &te):
+		return err
+	case errors.As(err, &partial):
+		partial.Err = classify(partial.Err)
+		return err
+	case errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT):
+		kind = ErrDiskFull
+	case errors.Is(err, ErrChunk):
+		kind = ErrChecksum
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		kind = ErrShortTransfer
+	case errors.As(err, &opErr) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE):
+		kind = ErrConnection
+	default:
+		return err
+	}
+	return &TransferError{Kind: kind, Err: err}
+}
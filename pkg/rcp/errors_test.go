@@ -0,0 +1,57 @@
+package rcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	tests := []struct {
+		name string
+		err  error
+		kind error // nil when err is returned as it is
+	}{
+		{"nil", nil, nil},
+		{"disk full", &os.PathError{Op: "write", Path: "out", Err: syscall.ENOSPC}, ErrDiskFull},
+		{"quota", fmt.Errorf("write: %w", syscall.EDQUOT), ErrDiskFull},
+		{"chunk", fmt.Errorf("chunk 3: %w", ErrChunk), ErrChecksum},
+		{"short", io.ErrUnexpectedEOF, ErrShortTransfer},
+		{"net", opErr, ErrConnection},
+		{"deadline", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), ErrConnection},
+		{"reset", syscall.ECONNRESET, ErrConnection},
+		{"refused", syscall.ECONNREFUSED, ErrConnection},
+		{"broken pipe", syscall.EPIPE, ErrConnection},
+		{"aborted", ErrPeerAborted, nil},
+		{"canceled", context.Canceled, nil},
+		{"other", errors.New("other"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.err)
+			var te *TransferError
+			if tt.kind == nil {
+				if got != tt.err {
+					t.Fatalf("classify() = %v, want %v", got, tt.err)
+				}
+				return
+			}
+			if !errors.As(got, &te) || te.Kind != tt.kind || !errors.Is(got, tt.kind) || !errors.Is(got, tt.err) {
+				t.Fatalf("classify() = %v, want a %v wrapping %v", got, tt.kind, tt.err)
+			}
+			if again := classify(got); again != got {
+				t.Fatalf("classify() classified %v again as %v", got, again)
+			}
+			partial := &PartialError{Err: tt.err, Name: "out", Offset: 10}
+			if got := classify(partial); got != partial || !errors.Is(got, tt.kind) {
+				t.Fatalf("classify() of a partial output = %v, want a %v", got, tt.kind)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package rcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fsync policies of the output file
+const (
+	FsyncNone     = "none"     // leave it to the OS
+	FsyncEnd      = "end"      // sync once the file is complete
+	FsyncInterval = "interval" // sync every FsyncInterval and at the end
+)
+
+// ErrFsync error type of an unknown fsync policy
+var ErrFsync = errors.New("The fsync policy must be none, end or interval")
+
+// fileWriter writes the output file: sequentially or at offsets, with holes,
+// and with aligned blocks when opened with O_DIRECT
+type fileWriter struct {
+	f      *os.File
+	direct bool
+	buf    []byte // staging of the unaligned rest with direct
+	n      int
+	pos    int64 // offset of the next sequential write
+	start  int64 // offset of the first write
+	device bool  // a block device, holes are zeroed instead of punched
+	zeroed bool  // the block device already reads as zeros
+
+	mu  sync.Mutex
+	end int64 // end of the last hole, the file is extended to it on Close
+
+	name  string // final name of a file written under tmp
+	tmp   string
+	fsync string
+	meta  *fileMeta
+	ack   *acker // acknowledges the bytes made durable by each periodic sync
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newFileWriter(f *os.File, direct bool, size int) (*fileWriter, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWriter{f: f, direct: direct, pos: pos, start: pos, fsync: FsyncNone}
+	if direct {
+		fw.buf = alignedBlock(size)
+	}
+	return fw, nil
+}
+
+// tempName returns the name the output is written under until it is complete
+func tempName(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, fmt.Sprintf(".%s.rcp-%d", base, os.Getpid()))
+}
+
+// syncEvery starts syncing the file every d until Close
+func (fw *fileWriter) syncEvery(d time.Duration) {
+	fw.stop = make(chan struct{})
+	fw.wg.Add(1)
+	go func() {
+		defer fw.wg.Done()
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fw.stop:
+				return
+			case <-ticker.C:
+				if fw.ack == nil {
+					fw.f.Sync()
+					break
+				}
+				if n := fw.ack.durable(); fw.f.Sync() == nil {
+					fw.ack.ack(n)
+				}
+			}
+		}
+	}()
+}
+
+func (fw *fileWriter) stopSync() {
+	if fw.stop != nil {
+		close(fw.stop)
+		fw.wg.Wait()
+		fw.stop = nil
+	}
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if !fw.direct {
+		n, err := fw.f.Write(p)
+		fw.pos += int64(n)
+		return n, err
+	}
+	total := len(p)
+	for len(p) > 0 {
+		if fw.n == 0 && len(p) >= blockAlign && isAligned(p) {
+			// write straight from the caller's buffer
+			k := len(p) &^ (blockAlign - 1)
+			if _, err := fw.f.Write(p[:k]); err != nil {
+				return total - len(p), err
+			}
+			p = p[k:]
+			fw.pos += int64(k)
+			continue
+		}
+		c := copy(fw.buf[fw.n:], p)
+		fw.n += c
+		p = p[c:]
+		fw.pos += int64(c)
+		if fw.n == len(fw.buf) {
+			if _, err := fw.f.Write(fw.buf); err != nil {
+				return total - len(p), err
+			}
+			fw.n = 0
+		}
+	}
+	return total, nil
+}
+
+// flush writes the staged bytes, dropping O_DIRECT for an unaligned tail
+func (fw *fileWriter) flush() error {
+	k := fw.n &^ (blockAlign - 1)
+	if k > 0 {
+		if _, err := fw.f.Write(fw.buf[:k]); err != nil {
+			return err
+		}
+	}
+	if k == fw.n {
+		fw.n = 0
+		return nil
+	}
+	if err := clearDirect(fw.f); err != nil {
+		return err
+	}
+	_, err := fw.f.Write(fw.buf[k:fw.n])
+	fw.n = 0
+	return err
+}
+
+// WriteAt writes p at off, dropping O_DIRECT for an unaligned tail
+func (fw *fileWriter) WriteAt(p []byte, off int64) (int, error) {
+	if fw.direct && (len(p)%blockAlign != 0 || off%blockAlign != 0 || !isAligned(p)) {
+		if err := clearDirect(fw.f); err != nil {
+			return 0, err
+		}
+	}
+	return fw.f.WriteAt(p, off)
+}
+
+// WriteHole skips n bytes of zeros at the current position
+func (fw *fileWriter) WriteHole(n int64) error {
+	if fw.n > 0 {
+		if err := fw.flush(); err != nil {
+			return err
+		}
+	}
+	if err := fw.WriteHoleAt(fw.pos, n); err != nil {
+		return err
+	}
+	fw.pos += n
+	_, err := fw.f.Seek(fw.pos, io.SeekStart)
+	return err
+}
+
+// WriteHoleAt deallocates n bytes at off
+func (fw *fileWriter) WriteHoleAt(off, n int64) error {
+	if fw.device {
+		return fw.zeroDevice(off, n)
+	}
+	if err := punchHole(fw.f, off, n); err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	if fw.end < off+n {
+		fw.end = off + n
+	}
+	fw.mu.Unlock()
+	return nil
+}
+
+// Close completes the file, applies the metadata, syncs it by the fsync policy and moves it into place
+func (fw *fileWriter) Close() error {
+	fw.stopSync()
+	err := fw.flush()
+	if err == nil {
+		err = fw.extend()
+	}
+	if err == nil && fw.meta != nil {
+		warn(applyMeta(fw.f, fw.meta))
+	}
+	if err == nil && fw.fsync != FsyncNone {
+		err = fw.f.Sync()
+	}
+	if cerr := fw.f.Close(); err == nil {
+		err = cerr
+	}
+	if len(fw.tmp) == 0 {
+		return err
+	}
+	if err != nil {
+		os.Remove(fw.tmp)
+		return err
+	}
+	if err = os.Rename(fw.tmp, fw.name); err != nil {
+		os.Remove(fw.tmp)
+		return err
+	}
+	if fw.meta != nil {
+		if terr := applyTimes(fw.name, fw.meta); terr != nil {
+			warn([]error{terr})
+		}
+	}
+	if fw.fsync != FsyncNone {
+		err = syncDir(filepath.Dir(fw.name))
+	}
+	return err
+}
+
+// abort closes the file and removes it when it was not written in place
+func (fw *fileWriter) abort() error {
+	fw.stopSync()
+	err := fw.f.Close()
+	if len(fw.tmp) > 0 {
+		if rerr := os.Remove(fw.tmp); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// keep syncs and closes the incomplete file and returns its name, name.part when it was written under tmp
+func (fw *fileWriter) keep() (string, error) {
+	fw.stopSync()
+	err := fw.flush()
+	if err == nil {
+		err = fw.f.Sync()
+	}
+	if cerr := fw.f.Close(); err == nil {
+		err = cerr
+	}
+	if len(fw.tmp) == 0 {
+		return fw.name, err
+	}
+	part := fw.name + partSuffix
+	if err == nil {
+		err = os.Rename(fw.tmp, part)
+	}
+	if err != nil {
+		os.Remove(fw.tmp)
+		return "", err
+	}
+	return part, nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// extend makes the file long enough for a trailing hole
+func (fw *fileWriter) extend() error {
+	if fw.end == 0 {
+		return nil
+	}
+	fi, err := fw.f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() >= fw.end {
+		return err
+	}
+	return fw.f.Truncate(fw.end)
+}
+
+// zeroDevice zeroes n bytes at off of a block device, unless it is known to read as zeros
+func (fw *fileWriter) zeroDevice(off, n int64) error {
+	if fw.zeroed {
+		return nil
+	}
+	if off%512 == 0 && n%512 == 0 && zeroOut(fw.f, off, n) == nil {
+		return nil
+	}
+	for n > 0 {
+		b := zeroBlock
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if _, err := fw.WriteAt(b, off); err != nil {
+			return err
+		}
+		off += int64(len(b))
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+// zeroFill writes zeros over the part of [off, off+n) inside the file
+func zeroFill(f *os.File, off, n int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if off+n > fi.Size() {
+		n = fi.Size() - off
+	}
+	zero := make([]byte, 64*1024)
+	for n > 0 {
+		b := zero
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if _, err := f.WriteAt(b, off); err != nil {
+			return err
+		}
+		off += int64(len(b))
+		n -= int64(len(b))
+	}
+	return nil
+}
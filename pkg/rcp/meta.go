@@ -0,0 +1,165 @@
+package rcp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// metadata preserved with Rcp.Preserve
+const (
+	PreserveMode  = "mode"
+	PreserveOwner = "owner"
+	PreserveTimes = "times"
+	PreserveXattr = "xattr" // user.* attributes and POSIX ACLs stored as system.posix_acl_* attributes
+	PreserveSetid = "setid" // on the listener, keep the setuid, setgid and sticky bits of mode
+)
+
+// ErrPreserve error type of an unknown preserve option
+var ErrPreserve = errors.New("The preserve options must be mode, owner, times, xattr or setid")
+
+var errUnsupported = errors.New("not supported on this platform")
+
+// fileMeta metadata of the input file sent in the header
+type fileMeta struct {
+	Mode   *os.FileMode      `json:"mode,omitempty"`
+	UID    *int              `json:"uid,omitempty"`
+	GID    *int              `json:"gid,omitempty"`
+	Atime  *time.Time        `json:"atime,omitempty"`
+	Mtime  *time.Time        `json:"mtime,omitempty"`
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// readMeta reads the metadata listed in preserve, warnings are what could not be read
+func readMeta(f *os.File, preserve []string) (m *fileMeta, warnings []error, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	m = &fileMeta{}
+	for _, p := range preserve {
+		switch p {
+		case PreserveMode:
+			mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			m.Mode = &mode
+		case PreserveOwner:
+			uid, gid, ok := fileOwner(fi)
+			if !ok {
+				warnings = append(warnings, fmt.Errorf("owner of %s: %w", f.Name(), errUnsupported))
+				continue
+			}
+			m.UID, m.GID = &uid, &gid
+		case PreserveTimes:
+			atime, mtime := fileAtime(fi), fi.ModTime()
+			m.Atime, m.Mtime = &atime, &mtime
+		case PreserveXattr:
+			var errs []error
+			m.Xattrs, errs = readXattrs(f)
+			warnings = append(warnings, errs...)
+		case PreserveSetid:
+			// the bits are sent with mode, only the listener decides to keep them
+		default:
+			return nil, nil, fmt.Errorf("%w: %q", ErrPreserve, p)
+		}
+	}
+	return m, warnings, nil
+}
+
+// CheckPreserve returns ErrPreserve when preserve lists an unknown option
+func CheckPreserve(preserve []string) error {
+	for _, p := range preserve {
+		switch p {
+		case PreserveMode, PreserveOwner, PreserveTimes, PreserveXattr, PreserveSetid:
+		default:
+			return fmt.Errorf("%w: %q", ErrPreserve, p)
+		}
+	}
+	return nil
+}
+
+// allowed returns the part of the metadata sent by the peer that the listener lists in its own preserve,
+// warnings are the kinds it leaves out
+func (m *fileMeta) allowed(preserve []string) (a *fileMeta, warnings []error, err error) {
+	if err = CheckPreserve(preserve); err != nil {
+		return nil, nil, err
+	}
+	kinds := map[string]bool{}
+	for _, p := range preserve {
+		kinds[p] = true
+	}
+	if m == nil {
+		return nil, nil, nil
+	}
+	a = &fileMeta{}
+	keep := func(kind string, sent bool) bool {
+		if sent && !kinds[kind] {
+			warnings = append(warnings, fmt.Errorf("%s of the sender not applied, it is not in the --preserve of the listener", kind))
+		}
+		return sent && kinds[kind]
+	}
+	if keep(PreserveMode, m.Mode != nil) {
+		mode := *m.Mode
+		if special := mode &^ os.ModePerm; special != 0 && !kinds[PreserveSetid] {
+			warnings = append(warnings, fmt.Errorf("mode %s: setuid, setgid and sticky bits not applied without setid in the --preserve of the listener", *m.Mode))
+			mode &= os.ModePerm
+		}
+		a.Mode = &mode
+	}
+	if keep(PreserveOwner, m.UID != nil && m.GID != nil) {
+		a.UID, a.GID = m.UID, m.GID
+	}
+	if keep(PreserveTimes, m.Atime != nil && m.Mtime != nil) {
+		a.Atime, a.Mtime = m.Atime, m.Mtime
+	}
+	if keep(PreserveXattr, len(m.Xattrs) > 0) {
+		a.Xattrs = m.Xattrs
+	}
+	return a, warnings, nil
+}
+
+// xattrAllowed reports whether the listener sets the extended attribute name,
+// the other namespaces grant capabilities or are reserved to the system
+func xattrAllowed(name string) bool {
+	return strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "system.posix_acl_")
+}
+
+// applyMeta applies the metadata but the times to f, warnings are what could not be applied
+func applyMeta(f *os.File, m *fileMeta) (warnings []error) {
+	for name, value := range m.Xattrs {
+		if !xattrAllowed(name) {
+			warnings = append(warnings, fmt.Errorf("xattr %s: not applied, only user.* and system.posix_acl_* are", name))
+			continue
+		}
+		if err := setXattr(f, name, value); err != nil {
+			warnings = append(warnings, fmt.Errorf("xattr %s: %w", name, err))
+		}
+	}
+	if m.UID != nil && m.GID != nil {
+		// chown clears the setuid and setgid bits, so it comes before chmod
+		if err := f.Chown(*m.UID, *m.GID); err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+	if m.Mode != nil {
+		if err := f.Chmod(*m.Mode); err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+	return warnings
+}
+
+// applyTimes sets the times of name once nothing writes to it anymore
+func applyTimes(name string, m *fileMeta) error {
+	if m.Atime == nil || m.Mtime == nil {
+		return nil
+	}
+	return os.Chtimes(name, *m.Atime, *m.Mtime)
+}
+
+func warn(warnings []error) {
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "preserve: %s\n", w)
+	}
+}
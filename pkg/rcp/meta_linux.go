@@ -0,0 +1,62 @@
+package rcp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+func fileAtime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
+
+// readXattrs reads the extended attributes of f, errors are the ones that could not be read
+func readXattrs(f *os.File) (map[string][]byte, []error) {
+	fd := int(f.Fd())
+	size, err := unix.Flistxattr(fd, nil)
+	if err != nil || size == 0 {
+		if err != nil {
+			return nil, []error{fmt.Errorf("xattrs of %s: %w", f.Name(), err)}
+		}
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Flistxattr(fd, buf); err != nil {
+		return nil, []error{fmt.Errorf("xattrs of %s: %w", f.Name(), err)}
+	}
+	attrs := map[string][]byte{}
+	var errs []error
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		n, err := unix.Fgetxattr(fd, name, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("xattr %s: %w", name, err))
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Fgetxattr(fd, name, value); err != nil {
+			errs = append(errs, fmt.Errorf("xattr %s: %w", name, err))
+			continue
+		}
+		attrs[name] = value[:n]
+	}
+	return attrs, errs
+}
+
+func setXattr(f *os.File, name string, value []byte) error {
+	return unix.Fsetxattr(int(f.Fd()), name, value, 0)
+}
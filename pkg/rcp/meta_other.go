@@ -0,0 +1,19 @@
+//go:build !linux
+
+package rcp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) { return 0, 0, false }
+
+func fileAtime(fi os.FileInfo) time.Time { return fi.ModTime() }
+
+func readXattrs(f *os.File) (map[string][]byte, []error) {
+	return nil, []error{fmt.Errorf("xattrs of %s: %w", f.Name(), errUnsupported)}
+}
+
+func setXattr(f *os.File, name string, value []byte) error { return errUnsupported }
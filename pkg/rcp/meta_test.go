@@ -0,0 +1,141 @@
+package rcp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMetaAllowed(t *testing.T) {
+	mode := func(m os.FileMode) *os.FileMode { return &m }
+	id := func(v int) *int { return &v }
+	now := time.Now()
+	all := &fileMeta{Mode: mode(0755 | os.ModeSetuid | os.ModeSticky), UID: id(1), GID: id(2), Atime: &now, Mtime: &now,
+		Xattrs: map[string][]byte{"user.a": []byte("1")}}
+	tests := []struct {
+		name     string
+		m        *fileMeta
+		preserve []string
+		want     *fileMeta
+		warnings int
+		err      error
+	}{
+		{"nothing sent", nil, []string{"mode"}, nil, 0, nil},
+		{"nothing allowed", all, nil, &fileMeta{}, 4, nil},
+		{"mode without setid", all, []string{"mode"}, &fileMeta{Mode: mode(0755)}, 4, nil},
+		{"mode with setid", all, []string{"mode", "setid"},
+			&fileMeta{Mode: mode(0755 | os.ModeSetuid | os.ModeSticky)}, 3, nil},
+		{"plain mode", &fileMeta{Mode: mode(0640)}, []string{"mode"}, &fileMeta{Mode: mode(0640)}, 0, nil},
+		{"owner and times", all, []string{"owner", "times"},
+			&fileMeta{UID: all.UID, GID: all.GID, Atime: &now, Mtime: &now}, 2, nil},
+		{"all", all, []string{"mode", "owner", "times", "xattr", "setid"}, all, 0, nil},
+		{"nothing to apply", &fileMeta{}, []string{"xattr"}, &fileMeta{}, 0, nil},
+		{"unknown option", all, []string{"mode", "acl"}, nil, 0, ErrPreserve},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings, err := tt.m.allowed(tt.preserve)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("allowed() error = %v, want %v", err, tt.err)
+			}
+			if len(warnings) != tt.warnings {
+				t.Fatalf("allowed() warnings = %v, want %d", warnings, tt.warnings)
+			}
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("allowed() = %+v, want %+v", got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if (got.Mode == nil) != (tt.want.Mode == nil) || got.Mode != nil && *got.Mode != *tt.want.Mode {
+				t.Fatalf("allowed() mode = %v, want %v", got.Mode, tt.want.Mode)
+			}
+			if got.UID != tt.want.UID || got.GID != tt.want.GID || got.Atime != tt.want.Atime || got.Mtime != tt.want.Mtime ||
+				len(got.Xattrs) != len(tt.want.Xattrs) {
+				t.Fatalf("allowed() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXattrAllowed(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"user.comment", true},
+		{"system.posix_acl_access", true},
+		{"system.posix_acl_default", true},
+		{"security.capability", false},
+		{"security.selinux", false},
+		{"trusted.overlay.opaque", false},
+		{"system.nfs4_acl", false},
+		{"user", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := xattrAllowed(tt.name); got != tt.want {
+			t.Errorf("xattrAllowed(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMeta(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+	mode := func(m os.FileMode) *os.FileMode { return &m }
+	tests := []struct {
+		name     string
+		m        *fileMeta
+		want     os.FileMode
+		warnings int
+	}{
+		{"nothing", &fileMeta{}, 0600, 0},
+		{"mode", &fileMeta{Mode: mode(0640)}, 0640, 0},
+		{"setuid", &fileMeta{Mode: mode(0755 | os.ModeSetuid)}, 0755 | os.ModeSetuid, 0},
+		{"privileged xattrs", &fileMeta{Mode: mode(0644),
+			Xattrs: map[string][]byte{"security.capability": {1}, "trusted.x": {2}}}, 0644, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "out")
+			f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err = f.Chmod(0600); err != nil {
+				t.Fatal(err)
+			}
+			if warnings := applyMeta(f, tt.m); len(warnings) != tt.warnings {
+				t.Fatalf("applyMeta() warnings = %v, want %d", warnings, tt.warnings)
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode() &^ os.ModeType; got != tt.want {
+				t.Fatalf("mode %s, want %s", got, tt.want)
+			}
+			m, _, err := readMeta(f, []string{PreserveMode, PreserveSetid})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *m.Mode != tt.want {
+				t.Fatalf("readMeta() mode %s, want %s", *m.Mode, tt.want)
+			}
+		})
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, _, err = readMeta(f, []string{PreserveMode, "acl"}); !errors.Is(err, ErrPreserve) {
+		t.Fatalf("readMeta() error = %v, want %v", err, ErrPreserve)
+	}
+}
@@ -0,0 +1,101 @@
+package rcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapReadWorker hands slices of a mapping of the input file to the writer instead of
+// reading into buffers; unmap releases the mapping once the writer is done with them
+func (tc *threadCopy) mmapReadWorker() (worker func(context.Context, chan result), unmap func()) {
+	f, ok := tc.r.(*os.File)
+	if !ok {
+		return nil, nil
+	}
+	fsize, err := fileSize(f)
+	if err != nil || fsize <= 0 {
+		return nil, nil
+	}
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil
+	}
+	end := tc.inputEnd(start, fsize)
+	if end <= start {
+		return nil, nil
+	}
+	page := int64(os.Getpagesize())
+	base := start &^ (page - 1)
+	m, err := unix.Mmap(int(f.Fd()), base, int(end-base), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil
+	}
+	unix.Madvise(m, unix.MADV_SEQUENTIAL)
+	data := m[start-base:]
+	tc.bs.mapInput()
+	worker = func(ctx context.Context, res chan result) {
+		size := uint64(0)
+		var err error
+		defer close(tc.queue)
+		defer func() { res <- result{size, err}; close(res) }()
+		debug.SetPanicOnFault(true)
+		defer recoverFault(&err)
+		for off := 0; off < len(data); {
+			n := tc.bs.bufSize()
+			if n > len(data)-off {
+				n = len(data) - off
+			}
+			// the pages past the end of a truncated file fault instead of reading
+			var cur int64
+			if cur, err = fileSize(f); err != nil {
+				return
+			}
+			if cur < start+int64(off+n) {
+				err = fmt.Errorf("%w: the input shrank to %d bytes while it was mapped", ErrShortTransfer, cur)
+				return
+			}
+			willNeed(m, int64(off)+start-base+int64(n), int64(n), page)
+			buf := tc.bs.Get()
+			if buf == nil {
+				err = ctx.Err()
+				return
+			}
+			*buf = data[off : off+n : off+n]
+			ch := chunk{buf: buf, off: int64(off)}
+			if tc.sparse && isZero(*buf) {
+				tc.bs.Put(buf)
+				ch = chunk{off: int64(off), hole: int64(n)}
+			}
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case tc.queue <- ch:
+			}
+			atomic.AddUint64(&tc.inputBytes, uint64(n))
+			size += uint64(n)
+			off += n
+		}
+		err = io.EOF
+	}
+	return worker, func() { unix.Munmap(m) }
+}
+
+// willNeed asks the kernel to read ahead n bytes at off of the mapping m
+func willNeed(m []byte, off, n, page int64) {
+	from := off &^ (page - 1)
+	if from >= int64(len(m)) {
+		return
+	}
+	to := off + n
+	if to > int64(len(m)) {
+		to = int64(len(m))
+	}
+	unix.Madvise(m[from:to], unix.MADV_WILLNEED)
+}
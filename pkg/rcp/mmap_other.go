@@ -0,0 +1,10 @@
+//go:build !linux
+
+package rcp
+
+import "context"
+
+// mmapReadWorker the mapped input is only implemented on Linux
+func (tc *threadCopy) mmapReadWorker() (worker func(context.Context, chan result), unmap func()) {
+	return nil, nil
+}
@@ -0,0 +1,160 @@
+package rcp
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelReadWorker reads regions of a regular file or a block device with ReadAt from tc.readers goroutines
+func (tc *threadCopy) parallelReadWorker() func(context.Context, chan result) {
+	f, ok := tc.r.(*os.File)
+	if !ok {
+		return nil
+	}
+	fsize, err := fileSize(f)
+	if err != nil || fsize < 0 {
+		return nil
+	}
+	return func(ctx context.Context, res chan result) {
+		size := uint64(0)
+		var err error
+		defer close(tc.queue)
+		defer func() { res <- result{size, err}; close(res) }()
+		var start int64
+		if start, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		next := start
+		errs := make(chan error, tc.readers)
+		var wg sync.WaitGroup
+		wg.Add(tc.readers)
+		for i := 0; i < tc.readers; i++ {
+			go func() {
+				defer wg.Done()
+				if err := tc.readAtWorker(ctx, f, &next, start, tc.inputEnd(start, fsize), &size); err != io.EOF {
+					errs <- err
+					cancel()
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		err = io.EOF
+		for e := range errs {
+			err = e
+			break
+		}
+	}
+}
+
+func (tc *threadCopy) readAtWorker(ctx context.Context, f *os.File, next *int64, start, end int64, size *uint64) error {
+	for {
+		// take the buffer before claiming a region, so that the writer can
+		// always receive the region it waits for
+		buf := tc.bs.Get()
+		if buf == nil {
+			return ctx.Err()
+		}
+		off := atomic.AddInt64(next, int64(len(*buf))) - int64(len(*buf))
+		if off >= end {
+			tc.bs.Put(buf)
+			return io.EOF
+		}
+		// keep the length aligned for O_DIRECT, the last read is short
+		if n := (end - off + blockAlign - 1) &^ (blockAlign - 1); n < int64(len(*buf)) {
+			*buf = (*buf)[:n]
+		}
+		c, err := f.ReadAt(*buf, off)
+		if err != nil && !(err == io.EOF && off+int64(c) >= end) {
+			return err
+		}
+		if off+int64(c) > end {
+			// the aligned read went past the end of the range
+			c = int(end - off)
+		}
+		*buf = (*buf)[:c]
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case tc.queue <- chunk{buf: buf, off: off - start}:
+		}
+		atomic.AddUint64(&tc.inputBytes, uint64(c))
+		atomic.AddUint64(size, uint64(c))
+	}
+}
+
+// parallelWriteWorker writes the chunks to a regular file or a block device with WriteAt from tc.writers goroutines
+func (tc *threadCopy) parallelWriteWorker() func(context.Context, chan result) {
+	fw, ok := tc.w.(*fileWriter)
+	if !ok {
+		return nil
+	}
+	f := fw.f
+	if fsize, err := fileSize(f); err != nil || fsize < 0 {
+		return nil
+	}
+	return func(ctx context.Context, res chan result) {
+		size := uint64(0)
+		var err error
+		defer func() { res <- result{size, err}; close(res) }()
+		var base int64
+		if base, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		errs := make(chan error, tc.writers)
+		var wg sync.WaitGroup
+		wg.Add(tc.writers)
+		for i := 0; i < tc.writers; i++ {
+			go func() {
+				defer wg.Done()
+				if err := tc.writeAtWorker(ctx, fw, base, &size); err != nil {
+					errs <- err
+					cancel()
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for e := range errs {
+			err = e
+			break
+		}
+	}
+}
+
+func (tc *threadCopy) writeAtWorker(ctx context.Context, fw *fileWriter, base int64, size *uint64) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch, ok := <-tc.queue:
+			if !ok {
+				return nil
+			}
+			if ch.buf == nil {
+				if err := fw.WriteHoleAt(base+ch.off, ch.hole); err != nil {
+					return err
+				}
+				atomic.AddUint64(&tc.skippedBytes, uint64(ch.hole))
+				atomic.AddUint64(size, uint64(ch.hole))
+				tc.written.add(ch.off, ch.hole)
+				continue
+			}
+			c, err := fw.WriteAt(*ch.buf, base+ch.off)
+			if err != nil {
+				return err
+			}
+			atomic.AddUint64(&tc.outputBytes, uint64(c))
+			atomic.AddUint64(size, uint64(c))
+			tc.written.add(ch.off, int64(c))
+			tc.bs.Put(ch.buf)
+		}
+	}
+}
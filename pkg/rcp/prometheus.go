@@ -0,0 +1,142 @@
+package rcp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PromExporter exposes transfer metrics in the Prometheus text format
+type PromExporter struct {
+	mu        sync.Mutex
+	transfers []*promTransfer
+}
+
+type promTransfer struct {
+	e       *PromExporter
+	labels  string
+	total   int64
+	running bool
+	errors  uint64
+	Metrics
+}
+
+// NewPromExporter create PromExporter struct
+func NewPromExporter() *PromExporter {
+	return &PromExporter{}
+}
+
+// Transfer registers a transfer and returns the Observer feeding its metrics
+func (e *PromExporter) Transfer(peer, file string, total int64) Observer {
+	return e.transfer(peer, file, total)
+}
+
+func (e *PromExporter) transfer(peer, file string, total int64) *promTransfer {
+	t := &promTransfer{e: e, running: true}
+	t.describe(peer, file, total)
+	e.mu.Lock()
+	e.transfers = append(e.transfers, t)
+	e.mu.Unlock()
+	return t
+}
+
+// describe sets the labels and the size of a transfer registered before its endpoints were open
+func (t *promTransfer) describe(peer, file string, total int64) {
+	t.e.mu.Lock()
+	t.labels = fmt.Sprintf(`peer="%s",file="%s"`, escapeLabel(peer), escapeLabel(file))
+	t.total = total
+	t.e.mu.Unlock()
+}
+
+func (t *promTransfer) Observe(m Metrics) {
+	t.e.mu.Lock()
+	t.Metrics = m
+	t.e.mu.Unlock()
+}
+
+func (t *promTransfer) Done(err error) {
+	t.e.mu.Lock()
+	defer t.e.mu.Unlock()
+	if !t.running {
+		// a transfer that failed to start is done once
+		return
+	}
+	t.running = false
+	if err != nil {
+		t.errors++
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type promMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(t *promTransfer) float64
+}
+
+var promMetrics = []promMetric{
+	{"rcp_transferred_bytes", "counter", "Bytes written to the destination.",
+		func(t *promTransfer) float64 { return float64(t.Size) }},
+	{"rcp_skipped_bytes", "counter", "Bytes of holes skipped instead of transferred.",
+		func(t *promTransfer) float64 { return float64(t.SkippedBytes) }},
+	{"rcp_network_bytes", "counter", "Bytes sent or received on the network by a delta transfer.",
+		func(t *promTransfer) float64 { return float64(t.WireBytes) }},
+	{"rcp_total_bytes", "gauge", "Size of the source in bytes (0 if unknown).",
+		func(t *promTransfer) float64 { return float64(t.total) }},
+	{"rcp_average_bytes_per_second", "gauge", "Average output speed since the transfer started.",
+		func(t *promTransfer) float64 { return float64(t.AvgByteSec) }},
+	{"rcp_input_bytes_per_second", "gauge", "Current input speed.",
+		func(t *promTransfer) float64 { return float64(t.InputByteSec) }},
+	{"rcp_input_max_bytes_per_second", "gauge", "Maximum input speed.",
+		func(t *promTransfer) float64 { return float64(t.InputMaxByteSec) }},
+	{"rcp_output_bytes_per_second", "gauge", "Current output speed.",
+		func(t *promTransfer) float64 { return float64(t.OutputByteSec) }},
+	{"rcp_output_max_bytes_per_second", "gauge", "Maximum output speed.",
+		func(t *promTransfer) float64 { return float64(t.OutputMaxByteSec) }},
+	{"rcp_buffer_used_bytes", "gauge", "Bytes queued between the reader and the writer.",
+		func(t *promTransfer) float64 { return float64(t.BufferUsed) }},
+	{"rcp_buffer_max_used_bytes", "gauge", "Maximum bytes queued between the reader and the writer.",
+		func(t *promTransfer) float64 { return float64(t.BufferMaxUsed) }},
+	{"rcp_buffer_limit_bytes", "gauge", "Memory the adaptive buffers may use now (with --maxMemory).",
+		func(t *promTransfer) float64 { return float64(t.BufferLimit) }},
+	{"rcp_reconnects_total", "counter", "Reconnections of the connection to the peer (with --retries).",
+		func(t *promTransfer) float64 { return float64(t.Reconnects) }},
+	{"rcp_downtime_seconds", "counter", "Time the connection to the peer was down before it was reconnected.",
+		func(t *promTransfer) float64 { return t.Downtime.Seconds() }},
+	{"rcp_acknowledged_bytes", "gauge", "Bytes the listener acknowledged as durable (with --checkpoint).",
+		func(t *promTransfer) float64 { return float64(t.Acknowledged) }},
+	{"rcp_transfer_duration_seconds", "gauge", "Time elapsed since the transfer started.",
+		func(t *promTransfer) float64 { return t.Elapsed.Seconds() }},
+	{"rcp_transfer_running", "gauge", "1 while the transfer is in progress.",
+		func(t *promTransfer) float64 {
+			if t.running {
+				return 1
+			}
+			return 0
+		}},
+	{"rcp_transfer_errors_total", "counter", "Number of transfers that ended with an error.",
+		func(t *promTransfer) float64 { return float64(t.errors) }},
+}
+
+func (e *PromExporter) writeTo(w io.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, pm := range promMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", pm.name, pm.help, pm.name, pm.typ)
+		for _, t := range e.transfers {
+			fmt.Fprintf(w, "%s{%s} %s\n", pm.name, t.labels, strconv.FormatFloat(pm.value(t), 'f', -1, 64))
+		}
+	}
+}
+
+func (e *PromExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	e.writeTo(w)
+}
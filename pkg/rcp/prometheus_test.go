@@ -0,0 +1,106 @@
+package rcp
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromExporter(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *PromExporter)
+		want  []string // lines of the exposition
+		not   []string
+	}{
+		{"no transfer", func(e *PromExporter) {}, []string{
+			"# HELP rcp_transferred_bytes Bytes written to the destination.",
+			"# TYPE rcp_transferred_bytes counter",
+			"# TYPE rcp_total_bytes gauge",
+		}, []string{"rcp_transferred_bytes{"}},
+		{"running", func(e *PromExporter) {
+			o := e.Transfer("192.0.2.1:1987", "/data/a.bin", 1000)
+			o.Observe(Metrics{Size: 400, AvgByteSec: 200, Elapsed: 1500 * time.Millisecond, Downtime: 250 * time.Millisecond})
+		}, []string{
+			`rcp_transferred_bytes{peer="192.0.2.1:1987",file="/data/a.bin"} 400`,
+			`rcp_total_bytes{peer="192.0.2.1:1987",file="/data/a.bin"} 1000`,
+			`rcp_average_bytes_per_second{peer="192.0.2.1:1987",file="/data/a.bin"} 200`,
+			`rcp_transfer_duration_seconds{peer="192.0.2.1:1987",file="/data/a.bin"} 1.5`,
+			`rcp_downtime_seconds{peer="192.0.2.1:1987",file="/data/a.bin"} 0.25`,
+			`rcp_transfer_running{peer="192.0.2.1:1987",file="/data/a.bin"} 1`,
+			`rcp_transfer_errors_total{peer="192.0.2.1:1987",file="/data/a.bin"} 0`,
+		}, nil},
+		{"failed", func(e *PromExporter) {
+			o := e.Transfer("p", "f", 0)
+			o.Done(errors.New("failed"))
+			o.Done(errors.New("failed again"))
+		}, []string{
+			`rcp_transfer_running{peer="p",file="f"} 0`,
+			`rcp_transfer_errors_total{peer="p",file="f"} 1`,
+		}, nil},
+		{"large counter", func(e *PromExporter) {
+			e.Transfer("p", "f", 1<<40).Observe(Metrics{Size: 1 << 40})
+		}, []string{
+			`rcp_transferred_bytes{peer="p",file="f"} 1099511627776`,
+		}, []string{"e+"}},
+		{"escaped labels", func(e *PromExporter) {
+			e.Transfer(`a"b`, "c\\d\ne", 0)
+		}, []string{
+			`rcp_total_bytes{peer="a\"b",file="c\\d\ne"} 0`,
+		}, nil},
+		{"described later", func(e *PromExporter) {
+			tr := e.transfer("", "", 0)
+			tr.describe("p", "out", 10)
+			tr.Done(nil)
+		}, []string{
+			`rcp_total_bytes{peer="p",file="out"} 10`,
+			`rcp_transfer_running{peer="p",file="out"} 0`,
+			`rcp_transfer_errors_total{peer="p",file="out"} 0`,
+		}, []string{`peer=""`}},
+		{"two transfers", func(e *PromExporter) {
+			e.Transfer("p", "a", 1)
+			e.Transfer("p", "b", 2)
+		}, []string{
+			`rcp_total_bytes{peer="p",file="a"} 1`,
+			`rcp_total_bytes{peer="p",file="b"} 2`,
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewPromExporter()
+			tt.setup(e)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+				t.Fatalf("Content-Type %q", ct)
+			}
+			b, _ := io.ReadAll(rec.Body)
+			body := string(b)
+			lines := map[string]bool{}
+			for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+				if lines[l] {
+					t.Fatalf("line %q repeated", l)
+				}
+				lines[l] = true
+			}
+			for _, l := range tt.want {
+				if !lines[l] {
+					t.Fatalf("line %q missing from\n%s", l, body)
+				}
+			}
+			for _, s := range tt.not {
+				if strings.Contains(body, s) {
+					t.Fatalf("%q in\n%s", s, body)
+				}
+			}
+			for _, pm := range promMetrics {
+				if !lines["# TYPE "+pm.name+" "+pm.typ] {
+					t.Fatalf("no TYPE of %s", pm.name)
+				}
+			}
+		})
+	}
+}
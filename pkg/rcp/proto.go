@@ -0,0 +1,671 @@
+package rcp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protoMagic starts every stream sent by rcp; a listener treats anything else as raw bytes
+const protoMagic = "RCP\x01"
+
+// protoVersion of the header; from version 2 on, the listener answers protoMagic to the sender
+const protoVersion = 2
+
+// helloTimeout bounds the wait for the listener to answer protoMagic
+const helloTimeout = 10 * time.Second
+
+// maxHeaderSize bounds the JSON header of a stream
+const maxHeaderSize = 1 << 20
+
+// frame types of the stream
+const (
+	frameHeader = 'H' // JSON encoded header
+	frameData   = 'D' // length bytes of data follow
+	frameHole   = 'Z' // length bytes of zeros, nothing follows
+	frameCopy   = 'C' // the block with index length of the listener's file, nothing follows
+	frameAbort  = 'A' // the peer gave up on the transfer, sent by either side
+	frameEnd    = 'E' // the end of the stream, length is the number of bytes sent
+	frameResume = 'R' // the bytes the listener received, its answer to a resumed connection
+	frameAck    = 'K' // length is the number of bytes the listener made durable, sent back with --checkpoint
+
+	frameSignatures = 'S' // block checksums sent back by the listener for --delta
+	frameChunks     = 'L' // hashes and sizes of up to cdcBatch chunks of the input for --cdc, an empty one ends the list
+	frameWanted     = 'W' // bitmap of the chunks of the last L frame the listener wants
+)
+
+const frameHeaderSize = 9
+
+// abortTimeout bounds sending and waiting for an abort frame
+const abortTimeout = time.Second
+
+// ErrProtocol error type of a malformed stream
+var ErrProtocol = errors.New("The stream is malformed")
+
+// header describes the stream to the listener
+type header struct {
+	Version int       `json:"version,omitempty"`
+	Size    int64     `json:"size"`
+	Sparse  bool      `json:"sparse,omitempty"`
+	Meta    *fileMeta `json:"meta,omitempty"`
+	Delta   bool      `json:"delta,omitempty"`
+	CDC     bool      `json:"cdc,omitempty"`
+	End     bool      `json:"end,omitempty"` // the stream finishes with an end frame
+
+	// with --retries, the listener waits RetryWait for the sender of Session to reconnect
+	Session   string        `json:"session,omitempty"`
+	RetryWait time.Duration `json:"retryWait,omitempty"`
+	Resume    bool          `json:"resume,omitempty"` // a reconnection of Session
+
+	// with --checkpoint, the listener acknowledges the bytes it made durable
+	Ack          bool  `json:"ack,omitempty"`
+	Acknowledged int64 `json:"acknowledged,omitempty"` // bytes of Session acknowledged before the stream started
+	Sent         int64 `json:"sent,omitempty"`         // bytes of the stream sent before a reconnection
+}
+
+// holeReader reader that reports the holes of its input
+type holeReader interface {
+	// ReadHole skips the hole at the current position and returns its length
+	// and the length of the data after it (0 if not known yet), or io.EOF at the end
+	ReadHole() (hole, data int64, err error)
+}
+
+// holeWriter writer that can skip n bytes of zeros
+type holeWriter interface {
+	WriteHole(n int64) error
+}
+
+// holeWriterAt writer that can skip n bytes of zeros at off
+type holeWriterAt interface {
+	WriteHoleAt(off, n int64) error
+}
+
+// wireCounter counts the bytes that actually crossed the network
+type wireCounter interface {
+	wireBytes() uint64
+}
+
+// writeMessage writes a frame with its payload
+func writeMessage(w io.Writer, typ byte, payload []byte) error {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:], uint64(len(payload)))
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+// writeCount writes a frame whose length is the count n, without a payload
+func writeCount(w io.Writer, typ byte, n int64) error {
+	var b [frameHeaderSize]byte
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:], uint64(n))
+	_, err := w.Write(b[:])
+	return err
+}
+
+// readCount reads a frame without a payload and returns its type and count
+func readCount(r io.Reader) (byte, int64, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	n := int64(binary.BigEndian.Uint64(hdr[1:]))
+	if n < 0 {
+		return 0, 0, ErrProtocol
+	}
+	return hdr[0], n, nil
+}
+
+// readMessage reads a frame of type typ with its payload
+func readMessage(r io.Reader, typ byte) ([]byte, error) {
+	return readFrame(r, typ, math.MaxInt32)
+}
+
+// readFrame reads a frame of type typ with a payload of at most max bytes
+func readFrame(r io.Reader, typ byte, max int) ([]byte, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint64(hdr[1:])
+	if hdr[0] == frameAbort && typ != frameAbort {
+		return nil, ErrPeerAborted
+	}
+	if hdr[0] != typ || n > uint64(max) {
+		return nil, ErrProtocol
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// protoWriter sends data and holes as frames
+type protoWriter struct {
+	mu     sync.Mutex // guards conn against interrupt while it is replaced
+	conn   net.Conn
+	hdr    [frameHeaderSize]byte
+	delta  *deltaWriter
+	chunks *cdcWriter
+	wire   uint64 // atomic counter
+	torn   bool   // a frame was cut short, nothing more can be sent
+	sent   int64  // bytes of the input sent, announced by the end frame
+
+	retry   *retrier // reconnects after a failure with --retries
+	stats   reconnectStats
+	stopped int32 // atomic, the copy was interrupted
+
+	acks    *ackStream // the acknowledgments of the listener with --checkpoint
+	ackc    chan struct{}
+	acked   int64 // atomic, bytes of the stream the listener acknowledged
+	journal *journal
+}
+
+func newProtoWriter(conn net.Conn, h header) (*protoWriter, error) {
+	pw := &protoWriter{conn: conn}
+	h.Version, h.End = protoVersion, true
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(conn, protoMagic); err != nil {
+		return nil, err
+	}
+	if err = pw.writeFrame(frameHeader, int64(len(b))); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+	if err = readHello(conn); err != nil {
+		return nil, err
+	}
+	if h.Resume {
+		// a restarted sender sends the whole stream, the listener continues where it acknowledged it
+		var answer []byte
+		if answer, err = readMessage(conn, frameResume); err != nil {
+			return nil, err
+		}
+		var skip int64
+		if skip, err = getOffset(answer); err == nil && skip != 0 {
+			err = fmt.Errorf("%w: the listener has no checkpoint of session %s", ErrResume, h.Session)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.Delta {
+		var sigs *signatures
+		if sigs, err = recvSignatures(conn); err != nil {
+			return nil, err
+		}
+		if len(sigs.weak) > 0 {
+			pw.delta = &deltaWriter{sigs: sigs, pw: pw}
+		}
+	}
+	return pw, nil
+}
+
+// readHello waits for the listener to answer protoMagic, an older rcp would write the frames into its output
+func readHello(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	magic := make([]byte, len(protoMagic))
+	_, err := io.ReadFull(conn, magic)
+	switch {
+	case err == nil && string(magic) == protoMagic:
+		return nil
+	case err == nil && magic[0] == frameAbort:
+		return ErrPeerAborted
+	case err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && err != io.EOF && err != io.ErrUnexpectedEOF:
+		return err
+	}
+	return fmt.Errorf("%w: the listener does not answer the protocol of this rcp, it may be an older version", ErrProtocol)
+}
+
+func (pw *protoWriter) writeFrame(typ byte, n int64) error {
+	pw.hdr[0] = typ
+	binary.BigEndian.PutUint64(pw.hdr[1:], uint64(n))
+	c, err := pw.conn.Write(pw.hdr[:])
+	atomic.AddUint64(&pw.wire, uint64(c))
+	if err != nil {
+		pw.torn = true
+	}
+	return err
+}
+
+func (pw *protoWriter) Write(p []byte) (n int, err error) {
+	switch {
+	case pw.delta != nil:
+		n, err = pw.delta.Write(p)
+	case pw.chunks != nil:
+		n, err = pw.chunks.Write(p)
+	default:
+		n, err = pw.writeData(p)
+	}
+	if err != nil && pw.retry != nil {
+		// the input is sent again from what the listener received
+		pw.sent += int64(len(p))
+		return len(p), pw.resume(err)
+	}
+	pw.sent += int64(n)
+	return
+}
+
+func (pw *protoWriter) writeData(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	pw.hdr[0] = frameData
+	binary.BigEndian.PutUint64(pw.hdr[1:], uint64(len(p)))
+	bufs := net.Buffers{pw.hdr[:], p}
+	n, err := bufs.WriteTo(pw.conn)
+	atomic.AddUint64(&pw.wire, uint64(n))
+	if err != nil {
+		pw.torn = true
+	}
+	if n -= frameHeaderSize; n < 0 {
+		n = 0
+	}
+	return int(n), err
+}
+
+func (pw *protoWriter) WriteHole(n int64) error {
+	pw.sent += n
+	err := pw.writeHole(n)
+	if err != nil && pw.retry != nil {
+		return pw.resume(err)
+	}
+	return err
+}
+
+func (pw *protoWriter) writeHole(n int64) error {
+	for pw.chunks != nil && n > 0 {
+		// the chunks were cut with the zeros in them
+		b := zeroBlock
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if _, err := pw.chunks.Write(b); err != nil {
+			return err
+		}
+		n -= int64(len(b))
+	}
+	if n == 0 {
+		return nil
+	}
+	if pw.delta != nil {
+		if err := pw.delta.flush(); err != nil {
+			return err
+		}
+	}
+	return pw.writeFrame(frameHole, n)
+}
+
+func (pw *protoWriter) wireBytes() uint64 { return atomic.LoadUint64(&pw.wire) }
+
+// interrupt gives the frame being written abortTimeout to complete, so that the abort frame can follow it
+func (pw *protoWriter) interrupt() {
+	pw.mu.Lock()
+	atomic.StoreInt32(&pw.stopped, 1)
+	pw.conn.SetDeadline(time.Now().Add(abortTimeout))
+	pw.mu.Unlock()
+}
+
+func (pw *protoWriter) reconnects() (int, time.Duration) { return pw.stats.reconnects() }
+
+// abort tells the listener that the transfer was aborted and closes the connection
+func (pw *protoWriter) abort() error {
+	if !pw.torn {
+		pw.conn.SetDeadline(time.Now().Add(abortTimeout))
+		if pw.writeFrame(frameAbort, 0) == nil && pw.acks != nil {
+			// closing with unread acknowledgments would reset the connection before the listener reads the abort
+			if c, ok := pw.conn.(*net.TCPConn); ok {
+				c.CloseWrite()
+			}
+			<-pw.acks.done
+		}
+	}
+	pw.closeSource()
+	return pw.conn.Close()
+}
+
+// closeSource closes the input kept to send again after a reconnection
+func (pw *protoWriter) closeSource() {
+	if pw.retry != nil {
+		if c, ok := pw.retry.src.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// peerAborted returns ErrPeerAborted when the write error err was caused by the listener aborting
+func (pw *protoWriter) peerAborted(err error) error {
+	if s := pw.acks; s != nil {
+		select {
+		case <-s.done:
+			if s.err == ErrPeerAborted {
+				return s.err
+			}
+		case <-time.After(abortTimeout):
+		}
+		return err
+	}
+	pw.conn.SetReadDeadline(time.Now().Add(abortTimeout))
+	var hdr [frameHeaderSize]byte
+	if _, rerr := io.ReadFull(pw.conn, hdr[:]); rerr == nil && hdr[0] == frameAbort {
+		return ErrPeerAborted
+	}
+	return err
+}
+
+// Close sends the end frame and closes the connection
+func (pw *protoWriter) Close() error {
+	var err error
+	if pw.delta != nil {
+		err = pw.delta.flush()
+	}
+	if err == nil {
+		err = pw.end()
+	}
+	pw.closeSource()
+	if cerr := pw.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// end sends the end frame, and waits for the listener to confirm it with --retries
+// or to acknowledge everything with --checkpoint, reconnecting when it cannot with --retries
+func (pw *protoWriter) end() error {
+	for {
+		err := pw.writeFrame(frameEnd, pw.sent)
+		switch {
+		case err != nil:
+		case pw.acks != nil:
+			err = pw.waitAcked()
+		case pw.retry != nil:
+			_, err = readMessage(pw.conn, frameEnd)
+		}
+		if err == nil || pw.retry == nil {
+			return err
+		}
+		if err = pw.resume(err); err != nil {
+			return err
+		}
+	}
+}
+
+// protoReader reads the frames sent by protoWriter, holes read as zeros
+type protoReader struct {
+	rc     io.ReadCloser
+	header header
+	raw    []byte // bytes of a raw stream read while looking for protoMagic
+	isRaw  bool
+	remain int64 // data left in the current frame
+	hole   int64 // zeros left in the current hole
+	hdr    [frameHeaderSize]byte
+	wire   uint64 // atomic counter
+	end    int64  // bytes sent by the sender, -1 until the end frame
+
+	// with --retries, the bytes returned so far tell a reconnected sender where to resume
+	delivered int64
+	start     int64 // the stream resumed from a checkpoint at this offset
+	stats     reconnectStats
+	stopped   int32 // atomic, the copy was interrupted
+
+	// the listener's existing output and its signatures with --delta
+	base     *os.File
+	sigs     *signatures
+	fromBase bool // the current frame is a block of base at baseOff
+	baseOff  int64
+
+	chunks *cdcReader
+}
+
+func newProtoReader(rc io.ReadCloser) (*protoReader, error) {
+	pr := &protoReader{rc: rc, end: -1}
+	start := make([]byte, len(protoMagic)+frameHeaderSize)
+	n, err := io.ReadFull(rc, start)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint64(start[len(protoMagic)+1:]))
+	if n < len(start) || string(start[:len(protoMagic)]) != protoMagic || start[len(protoMagic)] != frameHeader ||
+		size <= 0 || size > maxHeaderSize {
+		// sent by a plain TCP client or an older rcp
+		pr.isRaw, pr.raw = true, start[:n]
+		return pr, nil
+	}
+	b := make([]byte, size)
+	c, err := io.ReadFull(rc, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if c < len(b) || json.Unmarshal(b, &pr.header) != nil {
+		// raw bytes that start like a stream of rcp
+		pr.header = header{}
+		pr.isRaw, pr.raw = true, append(start, b[:c]...)
+		return pr, nil
+	}
+	atomic.AddUint64(&pr.wire, frameHeaderSize)
+	if rs, ok := rc.(*reciveStream); ok && pr.header.Version >= 2 {
+		// a sender of version 1 never reads it
+		if _, err = io.WriteString(rs.conn, protoMagic); err != nil {
+			return nil, err
+		}
+	}
+	return pr, nil
+}
+
+// next reads the header of the next frame, io.EOF at the end of the stream
+func (pr *protoReader) next() (typ byte, n int64, err error) {
+	c, err := io.ReadFull(pr.rc, pr.hdr[:])
+	atomic.AddUint64(&pr.wire, uint64(c))
+	if err != nil {
+		if err == io.EOF && pr.header.End {
+			err = fmt.Errorf("%w: the stream ended without its end frame", ErrShortTransfer)
+		}
+		return
+	}
+	typ, n = pr.hdr[0], int64(binary.BigEndian.Uint64(pr.hdr[1:]))
+	if n < 0 {
+		err = ErrProtocol
+	}
+	return
+}
+
+// advance reads frame headers until there is data or a hole to read, io.EOF after the end frame
+func (pr *protoReader) advance() error {
+	for pr.remain == 0 && pr.hole == 0 {
+		if pr.end >= 0 {
+			return io.EOF
+		}
+		typ, n, err := pr.next()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case frameData:
+			pr.remain, pr.fromBase = n, false
+		case frameCopy:
+			if pr.sigs == nil || n >= int64(len(pr.sigs.weak)) {
+				return ErrProtocol
+			}
+			pr.remain, pr.fromBase = int64(pr.sigs.blockLen(int(n))), true
+			pr.baseOff = n * int64(pr.sigs.blockSize)
+		case frameHole:
+			pr.hole = n
+		case frameAbort:
+			return ErrPeerAborted
+		case frameEnd:
+			pr.end = n
+			if rs, ok := pr.rc.(*reciveStream); ok && len(pr.header.Session) > 0 {
+				// the sender waits for the confirmation before it closes
+				writeMessage(rs.conn, frameEnd, nil)
+			}
+		default:
+			return ErrProtocol
+		}
+	}
+	return nil
+}
+
+func (pr *protoReader) Read(b []byte) (int, error) {
+	for {
+		n, err := pr.read(b)
+		pr.delivered += int64(n)
+		if err == nil || !pr.resumable(err) {
+			return n, err
+		}
+		if err = pr.resume(err); err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+func (pr *protoReader) read(b []byte) (int, error) {
+	if pr.isRaw {
+		if len(pr.raw) > 0 {
+			n := copy(b, pr.raw)
+			pr.raw = pr.raw[n:]
+			return n, nil
+		}
+		return pr.rc.Read(b)
+	}
+	if pr.chunks != nil {
+		return pr.readChunks(b)
+	}
+	if err := pr.advance(); err != nil {
+		return 0, err
+	}
+	if pr.hole > 0 {
+		if int64(len(b)) > pr.hole {
+			b = b[:pr.hole]
+		}
+		for i := range b {
+			b[i] = 0
+		}
+		pr.hole -= int64(len(b))
+		return len(b), nil
+	}
+	return pr.readData(b)
+}
+
+// readData reads from the current data frame
+func (pr *protoReader) readData(b []byte) (int, error) {
+	if err := pr.advance(); err != nil {
+		return 0, err
+	}
+	if pr.hole > 0 {
+		return 0, ErrProtocol
+	}
+	if int64(len(b)) > pr.remain {
+		b = b[:pr.remain]
+	}
+	if pr.fromBase {
+		n, err := pr.base.ReadAt(b, pr.baseOff)
+		if n == len(b) {
+			err = nil
+		}
+		pr.baseOff += int64(n)
+		pr.remain -= int64(n)
+		return n, err
+	}
+	n, err := pr.rc.Read(b)
+	atomic.AddUint64(&pr.wire, uint64(n))
+	pr.remain -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (pr *protoReader) ReadHole() (hole, data int64, err error) {
+	for {
+		hole, data, err = pr.readHole()
+		pr.delivered += hole
+		if err == nil || !pr.resumable(err) {
+			return
+		}
+		if err = pr.resume(err); err != nil {
+			return
+		}
+	}
+}
+
+func (pr *protoReader) readHole() (hole, data int64, err error) {
+	if pr.isRaw {
+		return 0, math.MaxInt64, nil
+	}
+	if pr.chunks != nil {
+		if data = pr.chunks.chunkLeft(); data == 0 {
+			return 0, 0, pr.finish()
+		}
+		return 0, data, nil
+	}
+	if err = pr.advance(); err != nil {
+		return 0, 0, err
+	}
+	hole, pr.hole = pr.hole, 0
+	return hole, pr.remain, nil
+}
+
+// finish reads the end frame after the last chunk of a --cdc stream and prunes the chunk store
+func (pr *protoReader) finish() error {
+	err := pr.advance()
+	if err == nil {
+		return ErrProtocol
+	}
+	if err == io.EOF {
+		pr.chunks.prune()
+	}
+	return err
+}
+
+// delta answers the sender's --delta request with the signatures of the existing output name
+func (pr *protoReader) delta(w io.Writer, name string) error {
+	base, sigs, err := sendSignatures(w, name)
+	if err != nil {
+		return err
+	}
+	pr.base, pr.sigs = base, sigs
+	return nil
+}
+
+func (pr *protoReader) wireBytes() uint64 { return atomic.LoadUint64(&pr.wire) }
+
+func (pr *protoReader) reconnects() (int, time.Duration) { return pr.stats.reconnects() }
+
+func (pr *protoReader) SetDeadline(t time.Time) error {
+	atomic.StoreInt32(&pr.stopped, 1)
+	if d, ok := pr.rc.(deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// abort tells the sender that the transfer was aborted and closes the connection
+func (pr *protoReader) abort() error {
+	if rs, ok := pr.rc.(*reciveStream); ok && !pr.isRaw {
+		rs.conn.SetDeadline(time.Now().Add(abortTimeout))
+		writeMessage(rs.conn, frameAbort, nil)
+	}
+	return pr.Close()
+}
+
+func (pr *protoReader) Close() error {
+	if pr.base != nil {
+		pr.base.Close()
+	}
+	return pr.rc.Close()
+}
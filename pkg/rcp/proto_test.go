@@ -0,0 +1,285 @@
+package rcp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// segment data written to a protoWriter, or a hole when data is nil
+type segment struct {
+	data []byte
+	hole int64
+}
+
+// sendStream sends the stream of h and segs over conn, and ends it unless torn
+func sendStream(conn net.Conn, h header, segs []segment, torn bool) error {
+	pw, err := newProtoWriter(conn, h)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	for _, s := range segs {
+		if s.data == nil {
+			err = pw.WriteHole(s.hole)
+		} else {
+			_, err = pw.Write(s.data)
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if torn {
+		return conn.Close()
+	}
+	return pw.Close()
+}
+
+func TestProtoStream(t *testing.T) {
+	mode := os.FileMode(0640)
+	tests := []struct {
+		name string
+		h    header
+		segs []segment
+		torn bool
+		want error
+	}{
+		{"empty", header{}, nil, false, nil},
+		{"data", header{Size: 10}, []segment{{data: []byte("0123456789")}}, false, nil},
+		{"holes", header{Size: 1 << 20, Sparse: true}, []segment{{data: []byte("ab")}, {hole: 1<<20 - 4}, {data: []byte("cd")}}, false, nil},
+		{"meta", header{Size: 3, Meta: &fileMeta{Mode: &mode}}, []segment{{data: []byte("abc")}}, false, nil},
+		{"large", header{Size: 3 << 20}, []segment{{data: randBytes(4, 3<<20)}}, false, nil},
+		{"no end frame", header{Size: 10}, []segment{{data: []byte("01234")}}, true, ErrShortTransfer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			sent := make(chan error, 1)
+			go func() { sent <- sendStream(a, tt.h, tt.segs, tt.torn) }()
+			pr, err := newProtoReader(&reciveStream{conn: b, closed: make(chan struct{})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pr.isRaw {
+				t.Fatal("the stream was read as raw bytes")
+			}
+			want := tt.h
+			want.Version, want.End = protoVersion, true
+			if !reflect.DeepEqual(pr.header, want) {
+				t.Fatalf("header = %+v, want %+v", pr.header, want)
+			}
+			got, err := io.ReadAll(pr)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.want)
+			}
+			if err := <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil {
+				return
+			}
+			var data []byte
+			for _, s := range tt.segs {
+				if s.data == nil {
+					s.data = make([]byte, s.hole)
+				}
+				data = append(data, s.data...)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("read %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestProtoRaw(t *testing.T) {
+	frame := func(typ byte, size uint64, payload string) []byte {
+		b := append([]byte(protoMagic), typ, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(protoMagic)+1:], size)
+		return append(b, payload...)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"text", []byte("a plain text sent with nc, longer than the start of a stream\n")},
+		{"magic only", []byte(protoMagic)},
+		{"other frame", frame(frameData, 3, "abc")},
+		{"empty header", frame(frameHeader, 0, "")},
+		{"huge header", frame(frameHeader, maxHeaderSize+1, "{}")},
+		{"truncated header", frame(frameHeader, 100, `{"size":1}`)},
+		{"invalid header", frame(frameHeader, 5, "{size")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, err := newProtoReader(io.NopCloser(bytes.NewReader(tt.b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pr.isRaw {
+				t.Fatalf("the stream was read as a framed one with header %+v", pr.header)
+			}
+			got, err := io.ReadAll(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.b) {
+				t.Fatalf("read %q, want %q", got, tt.b)
+			}
+		})
+	}
+}
+
+func TestProtoOldSender(t *testing.T) {
+	// a sender of version 1 sends no version and never reads the answer of the listener
+	hb, _ := json.Marshal(header{Size: 3})
+	var stream bytes.Buffer
+	stream.WriteString(protoMagic)
+	writeMessage(&stream, frameHeader, hb)
+	writeMessage(&stream, frameData, []byte("abc"))
+	a, b := net.Pipe()
+	defer b.Close()
+	go func() {
+		a.Write(stream.Bytes())
+		a.Close()
+	}()
+	// writing the answer would block on the pipe nobody reads
+	b.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	pr, err := newProtoReader(&reciveStream{conn: b, closed: make(chan struct{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(pr)
+	if err != nil || string(got) != "abc" {
+		t.Fatalf("ReadAll() = %q, %v", got, err)
+	}
+}
+
+func TestReadHello(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []byte
+		want   error
+	}{
+		{"answer", []byte(protoMagic), nil},
+		{"abort", []byte{frameAbort, 0, 0, 0, 0, 0, 0, 0, 0}, ErrPeerAborted},
+		{"closed", nil, ErrProtocol},
+		{"short", []byte("RC"), ErrProtocol},
+		{"other bytes", []byte("HTTP/1.1 400"), ErrProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			go func() {
+				b.Write(tt.answer)
+				b.Close()
+			}()
+			if err := readHello(a); !errors.Is(err, tt.want) {
+				t.Fatalf("readHello() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     byte
+		payload []byte
+	}{
+		{"empty", frameChunks, nil},
+		{"chunks", frameChunks, marshalChunks([]cdcChunk{{sha256.Sum256(nil), 1}})},
+		{"wanted", frameWanted, []byte{0xff, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeMessage(&buf, tt.typ, tt.payload); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != frameHeaderSize+len(tt.payload) {
+				t.Fatalf("writeMessage() wrote %d bytes, want %d", buf.Len(), frameHeaderSize+len(tt.payload))
+			}
+			got, err := readFrame(&buf, tt.typ, len(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Fatalf("readFrame() = %x, want %x", got, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	frame := func(typ byte, payload []byte) *bytes.Buffer {
+		var buf bytes.Buffer
+		writeMessage(&buf, typ, payload)
+		return &buf
+	}
+	tests := []struct {
+		name string
+		r    io.Reader
+		typ  byte
+		max  int
+		want error
+	}{
+		{"other type", frame(frameWanted, nil), frameChunks, 10, ErrProtocol},
+		{"over max", frame(frameChunks, make([]byte, 11)), frameChunks, 10, ErrProtocol},
+		{"abort", frame(frameAbort, nil), frameChunks, 10, ErrPeerAborted},
+		{"short header", bytes.NewReader([]byte{frameChunks, 0}), frameChunks, 10, io.ErrUnexpectedEOF},
+		{"short payload", bytes.NewReader(frame(frameChunks, make([]byte, 5)).Bytes()[:frameHeaderSize+2]), frameChunks, 10, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readFrame(tt.r, tt.typ, tt.max); !errors.Is(err, tt.want) {
+				t.Fatalf("readFrame() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  byte
+		n    int64
+	}{
+		{"zero", frameEnd, 0},
+		{"resume", frameResume, 1 << 40},
+		{"max", frameAck, 1<<63 - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeCount(&buf, tt.typ, tt.n); err != nil {
+				t.Fatal(err)
+			}
+			typ, n, err := readCount(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != tt.typ || n != tt.n {
+				t.Fatalf("readCount() = %c %d, want %c %d", typ, n, tt.typ, tt.n)
+			}
+		})
+	}
+	var buf bytes.Buffer
+	writeCount(&buf, frameEnd, -1)
+	if _, _, err := readCount(&buf); err != ErrProtocol {
+		t.Fatalf("readCount() of a negative count error = %v, want %v", err, ErrProtocol)
+	}
+}
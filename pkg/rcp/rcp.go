@@ -2,28 +2,97 @@ package rcp
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"net"
+	"math"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // Rcp configs
 type Rcp struct {
-	MaxBufNum    int
-	BufSize      int
-	SingleThread bool
-	DummyInput   int64
-	DummyOutput  bool
-	DialAddr     string
-	Output       string
-	Input        string
-	ListenAddr   string
+	MaxBufNum     int
+	BufSize       int
+	MaxMemory     int64 // budget of the adaptive buffers, 0 keeps BufSize and MaxBufNum
+	SingleThread  bool
+	ZeroCopy      bool
+	Direct        bool
+	Uring         bool
+	Mmap          bool
+	QueueDepth    int
+	Readers       int
+	Writers       int
+	Sparse        bool
+	Fsync         string
+	FsyncInterval time.Duration
+	Preserve      []string
+	Delta         bool
+	CDC           bool
+	ChunkStore    string
+	ChunkStoreMax int64 // bytes of ChunkStore kept after a transfer, 0 keeps every chunk
+	Offset        int64 // first byte of the input to send
+	Length        int64 // bytes of the input to send, 0 sends up to the end
+	InPlace       bool  // patch the existing output at Seek instead of replacing it
+	Seek          int64
+	Zeroed        bool // the output block device reads as zeros, holes are not written
+	DummyInput    int64
+	DummyOutput   bool
+	DialAddr      string
+	Retries       int           // redials after the connection to the listener fails
+	RetryBackoff  time.Duration // wait before the first redial, doubled for every next one
+	Checkpoint    string        // journal of the bytes the listener acknowledged, to resume after a restart
+	SndBuf        int           // socket send buffer in bytes, 0 keeps the autotuning of the kernel
+	RcvBuf        int           // socket receive buffer in bytes, 0 keeps the autotuning of the kernel
+	Nagle         bool          // delay small segments instead of sending them at once with TCP_NODELAY
+	Congestion    string        // TCP congestion control algorithm, ex: bbr or cubic
+	MSS           int           // TCP maximum segment size, 0 keeps the one of the path
+	TOS           int           // IP TOS or IPv6 traffic class of the packets, the DSCP shifted left by 2
+	KeepAlive     time.Duration // period of the keepalive probes, 0 keeps the default of Go, negative disables them
+	UserTimeout   time.Duration // the connection fails once sent data stays unacknowledged this long
+	Output        string
+	Input         string
+	ListenAddr    string
+	MetricsAddr   string
+	WebAddr       string
+	MetricsLinger time.Duration // keep serving MetricsAddr and WebAddr after the transfer until Linger returns
+	SpeedWindow   time.Duration
+	ReportFile    string
+	Checksum      bool // hash the data in order with SHA-256, for the report and Sum
+	RecordFile    string
+	Observers     []Observer
 	*SpeedDashboard
+
+	peer    string
+	file    string
+	servers []*http.Server // serving MetricsAddr and WebAddr
+	web     *WebDashboard
+	hash    hash.Hash
+	holes   bool // the sender looks for holes
+	meta    *fileMeta
+	wire    wireCounter // network bytes of a delta transfer
+	tui     bool        // show the SpeedDashboard in the terminal
+	limit   int64       // bytes to read from the input with --length, 0 reads to the end
+	written *prefix     // bytes of the output written without a gap
+
+	ack        *acker   // the listener acknowledges the bytes it made durable
+	journal    *journal // the sender journals the acknowledgments with --checkpoint
+	restarted  bool     // the sender continues the transfer of its checkpoint
+	resumeFile string   // the incomplete output the listener continues from its checkpoint
+}
+
+// Observer receives the metrics samples of a transfer
+type Observer interface {
+	Observe(m Metrics)
+	Done(err error)
 }
 
 // ErrInput  error type of source is not specified
@@ -32,116 +101,814 @@ var ErrInput = errors.New("The source is not specified")
 // ErrOutput error type of destination is not specified
 var ErrOutput = errors.New("The destination is not specified")
 
-func (rcp *Rcp) openReader() (r io.ReadCloser, err error) {
+// ErrCDC error type of --cdc without an input file or with --delta
+var ErrCDC = errors.New("The --cdc mode needs an input file and cannot be combined with --delta")
+
+// ErrMaxMemory error type of a memory budget below the fewest buffers a transfer needs
+var ErrMaxMemory = errors.New("The memory budget is too small")
+
+// ErrChecksumMode error type of --checksum with a copy that does not write in order
+var ErrChecksumMode = errors.New("The --checksum mode hashes the data in order and cannot be combined with --zeroCopy, --uring or --writers")
+
+// ErrDirectAlign error type of buffer size not usable for direct I/O
+var ErrDirectAlign = fmt.Errorf("The buffer size must be a multiple of %d for direct I/O", blockAlign)
+
+// ErrDirectOffset error type of an offset not usable for direct I/O
+var ErrDirectOffset = fmt.Errorf("The offset and seek must be multiples of %d for direct I/O", blockAlign)
+
+// ErrRange error type of a byte range outside of the input
+var ErrRange = errors.New("The offset is past the end of the input")
+
+// ErrConnection error type of a failed connection to the peer
+var ErrConnection = errors.New("The connection to the peer failed")
+
+// ErrChecksum error type of data that does not match its checksum
+var ErrChecksum = errors.New("The data does not match its checksum")
+
+// ErrDiskFull error type of an output without space left
+var ErrDiskFull = errors.New("No space left for the output")
+
+// ErrPeerAborted error type of a transfer aborted by the other side
+var ErrPeerAborted = errors.New("The peer aborted the transfer")
+
+// ErrShortTransfer error type of a transfer that ended before the announced size
+var ErrShortTransfer = errors.New("The transfer ended before the announced size")
+
+const (
+	blockAlign = 4096
+)
+
+func (rcp *Rcp) openReader(ctx context.Context) (r io.ReadCloser, err error) {
 	switch {
 	case rcp.DummyInput > 0:
 		r = openDummyRead(rcp.DummyInput)
 		rcp.InputName = "dummy input"
+		rcp.file = rcp.InputName
 		rcp.TotalSize = rcp.DummyInput
 	case len(rcp.Input) > 0:
 		var f *os.File
-		if f, err = os.Open(rcp.Input); err != nil {
+		if f, err = rcp.openFile(rcp.Input, os.O_RDONLY); err != nil {
 			return
 		}
 		rcp.InputName = rcp.Input
-		var fi os.FileInfo
-		if fi, err = f.Stat(); err != nil {
+		rcp.file = rcp.Input
+		r = f
+		var size int64
+		if size, err = fileSize(f); err != nil {
 			return
 		}
-		r = f
-		rcp.TotalSize = fi.Size()
+		if size < 0 {
+			size = 0 // a pipe or a character device, read up to EOF
+		}
+		if err = rcp.selectRange(f, size); err != nil {
+			return
+		}
+		if len(rcp.Preserve) > 0 {
+			var warnings []error
+			if rcp.meta, warnings, err = readMeta(f, rcp.Preserve); err != nil {
+				return
+			}
+			warn(warnings)
+		}
+		if rcp.Sparse {
+			if r, err = newSparseReader(f, rcp.Offset+rcp.TotalSize); err != nil {
+				return
+			}
+		}
 	case len(rcp.ListenAddr) > 0:
-		if r, err = reciveStreamOpen(rcp.ListenAddr); err != nil {
+		var rs *reciveStream
+		if rs, err = reciveStreamOpen(ctx, rcp.listenConfig(), rcp.ListenAddr); err != nil {
+			return
+		}
+		if rcp.Nagle {
+			rs.nagle = true
+			setNagle(rs.conn)
+		}
+		rcp.peer = rs.conn.RemoteAddr().String()
+		var pr *protoReader
+		if pr, err = newProtoReader(rs); err != nil {
+			rs.Close()
 			return
 		}
+		if pr.header.RetryWait > 0 && len(pr.header.Session) > 0 {
+			rs.acceptResumes(pr.header.Session)
+		}
+		r = pr
 		rcp.InputName = rcp.ListenAddr
+		rcp.TotalSize = pr.header.Size
+		rcp.holes = pr.header.Sparse
+		var warnings []error
+		if rcp.meta, warnings, err = pr.header.Meta.allowed(rcp.Preserve); err != nil {
+			pr.Close()
+			return
+		}
+		warn(warnings)
+		if len(rcp.Checkpoint) > 0 || pr.header.Ack || pr.header.Resume {
+			if err = rcp.newAcker(pr, rs.conn); err != nil {
+				pr.Close()
+				return
+			}
+		}
+		switch {
+		case pr.header.Delta:
+			base := rcp.Output
+			if rcp.InPlace {
+				// the blocks would be overwritten while they are copied
+				base = ""
+			}
+			err = pr.delta(rs.conn, base)
+			rcp.wire = pr
+		case pr.header.CDC:
+			err = pr.cdc(rs.conn, &chunkStore{dir: rcp.chunkStore(), max: rcp.ChunkStoreMax})
+			rcp.wire = pr
+		}
+		if err != nil {
+			pr.Close()
+			return
+		}
 	default:
 		return r, ErrInput
 	}
 	return
 }
 
-func (rcp *Rcp) openWriter() (w io.WriteCloser, err error) {
+func (rcp *Rcp) openWriter(ctx context.Context) (w io.WriteCloser, err error) {
 	switch {
 	case rcp.DummyOutput:
 		w = openDummyWrite()
 		rcp.OutputName = "dummy output"
+		if len(rcp.file) == 0 {
+			rcp.file = rcp.OutputName
+		}
 	case len(rcp.Output) > 0:
-		if w, err = os.Create(rcp.Output); err != nil {
+		if w, err = rcp.openOutput(); err != nil {
 			return
 		}
 		rcp.OutputName = rcp.Output
+		rcp.file = rcp.Output
 	case len(rcp.DialAddr) > 0:
-		if w, err = net.Dial("tcp", rcp.DialAddr); err != nil {
+		var chunks []cdcChunk
+		if rcp.CDC {
+			if len(rcp.Input) == 0 || rcp.Delta {
+				return nil, ErrCDC
+			}
+			if chunks, err = chunkFile(rcp.Input, rcp.Offset, rcp.TotalSize); err != nil {
+				return
+			}
+		}
+		h := header{Size: rcp.TotalSize, Sparse: rcp.Sparse, Meta: rcp.meta, Delta: rcp.Delta, CDC: rcp.CDC}
+		if j := rcp.journal; j != nil {
+			h.Ack, h.Session = true, j.ckpt.Session
+			if rcp.restarted {
+				h.Resume, h.Acknowledged = true, j.base
+			} else {
+				j.ckpt.Size = rcp.TotalSize
+			}
+		}
+		var retry *retrier
+		if rcp.Retries > 0 {
+			if retry, err = rcp.newRetrier(ctx, &h); err != nil {
+				return
+			}
+		}
+		var pw *protoWriter
+		if pw, err = rcp.dial(ctx, h, chunks); err != nil {
+			if retry != nil {
+				if c, ok := retry.src.(io.Closer); ok {
+					c.Close()
+				}
+			}
 			return
 		}
+		pw.retry = retry
+		if h.Ack {
+			pw.startAcks(rcp.journal)
+		}
+		w = pw
+		if rcp.Delta || rcp.CDC {
+			rcp.wire = pw
+		}
 		rcp.OutputName = rcp.DialAddr
+		rcp.peer = rcp.DialAddr
 	default:
 		return w, ErrOutput
 	}
 	return
 }
 
+// dial connects to the listener and sends the header and the chunk list of --cdc
+func (rcp *Rcp) dial(ctx context.Context, h header, chunks []cdcChunk) (*protoWriter, error) {
+	conn, err := rcp.dialer().DialContext(ctx, "tcp", rcp.DialAddr)
+	if err != nil {
+		return nil, err
+	}
+	if rcp.Nagle {
+		setNagle(conn)
+	}
+	pw, err := newProtoWriter(conn, h)
+	if err == nil && rcp.CDC {
+		err = pw.cdc(chunks)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pw, nil
+}
+
+// openOutput opens a temporary file next to rcp.Output that replaces it once complete,
+// or the output itself at rcp.Seek to patch it in place
+func (rcp *Rcp) openOutput() (*fileWriter, error) {
+	name, flag, tmp := rcp.Output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, ""
+	switch {
+	case len(rcp.resumeFile) > 0:
+		// the incomplete output of the checkpoint replaces rcp.Output once complete
+		if rcp.Direct && rcp.Seek%blockAlign != 0 {
+			return nil, ErrDirectOffset
+		}
+		name, flag = rcp.resumeFile, os.O_RDWR
+		if name != rcp.Output {
+			tmp = name
+		}
+	case rcp.InPlace:
+		if rcp.Direct && rcp.Seek%blockAlign != 0 {
+			return nil, ErrDirectOffset
+		}
+		flag = os.O_RDWR | os.O_CREATE
+		if part := rcp.Output + partSuffix; isRegular(part) {
+			// continue the output kept by an interrupted transfer, it replaces rcp.Output once complete
+			fmt.Fprintf(os.Stderr, "Continuing %s at %d\n", part, rcp.Seek)
+			name, flag, tmp = part, os.O_RDWR, part
+		}
+	default:
+		if fi, err := os.Stat(name); err != nil || fi.Mode().IsRegular() {
+			tmp = tempName(name)
+			name, flag = tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL
+		} else {
+			// a device is written over, never truncated
+			flag = os.O_RDWR
+		}
+	}
+	f, err := rcp.openFile(name, flag)
+	if err != nil {
+		return nil, err
+	}
+	if rcp.Seek > 0 {
+		_, err = f.Seek(rcp.Seek, io.SeekStart)
+	}
+	var fw *fileWriter
+	if err == nil {
+		fw, err = newFileWriter(f, rcp.Direct, rcp.BufSize)
+	}
+	if err == nil {
+		err = rcp.checkDevice(fw)
+	}
+	if err == nil && rcp.TotalSize > 0 && !rcp.Sparse && !rcp.holes && !fw.device {
+		err = preallocate(f, fw.pos, rcp.TotalSize)
+	}
+	if err != nil {
+		f.Close()
+		if len(tmp) > 0 {
+			os.Remove(tmp)
+		}
+		return nil, err
+	}
+	fw.name, fw.tmp, fw.fsync = rcp.Output, tmp, rcp.Fsync
+	if len(tmp) > 0 {
+		// only files rcp creates get the metadata of the input
+		fw.meta = rcp.meta
+	}
+	if a := rcp.ack; a != nil {
+		// the acknowledged bytes are synced
+		if fw.fsync == FsyncNone {
+			fw.fsync = FsyncEnd
+		}
+		if j := a.journal; j != nil && len(rcp.resumeFile) == 0 {
+			j.ckpt.File, j.ckpt.Start = name, fw.start
+		}
+		fw.ack = a
+	}
+	if rcp.Fsync == FsyncInterval || fw.ack != nil {
+		fw.syncEvery(rcp.FsyncInterval)
+	}
+	return fw, nil
+}
+
+// newRetrier prepares the reconnections of --retries and adds the session to h
+func (rcp *Rcp) newRetrier(ctx context.Context, h *header) (*retrier, error) {
+	r := &retrier{ctx: ctx, addr: rcp.DialAddr, dialer: rcp.dialer(), nagle: rcp.Nagle,
+		retries: rcp.Retries, backoff: rcp.RetryBackoff, base: rcp.Offset}
+	if r.backoff <= 0 {
+		r.backoff = time.Second
+	}
+	switch {
+	case rcp.Delta || rcp.CDC:
+		return nil, ErrRetry
+	case rcp.DummyInput > 0:
+		r.src = zeroReaderAt{}
+	case len(rcp.Input) > 0:
+		f, err := os.Open(rcp.Input)
+		if err != nil {
+			return nil, err
+		}
+		if size, err := fileSize(f); err != nil || size < 0 {
+			// a pipe cannot be read again
+			f.Close()
+			return nil, ErrRetry
+		}
+		r.src = f
+	default:
+		return nil, ErrRetry
+	}
+	if len(h.Session) == 0 {
+		h.Session = newSession()
+	}
+	h.RetryWait = retryWait(r.retries, r.backoff)
+	r.header = *h
+	return r, nil
+}
+
+// checkDevice marks an output block device and checks that the input fits on it
+func (rcp *Rcp) checkDevice(fw *fileWriter) error {
+	fi, err := fw.f.Stat()
+	if err != nil || !isBlockDevice(fi) {
+		return err
+	}
+	size, err := deviceSize(fw.f)
+	if err != nil {
+		return err
+	}
+	if fw.pos+rcp.TotalSize > size {
+		return fmt.Errorf("%w: %d bytes at %d do not fit in %d", ErrDeviceSize, rcp.TotalSize, fw.pos, size)
+	}
+	fw.device, fw.zeroed = true, rcp.Zeroed
+	return nil
+}
+
+// selectRange seeks f to rcp.Offset and sets TotalSize to the length of the range
+func (rcp *Rcp) selectRange(f *os.File, size int64) error {
+	if rcp.Offset < 0 || rcp.Length < 0 || rcp.Offset > size {
+		return ErrRange
+	}
+	rcp.TotalSize = size - rcp.Offset
+	if rcp.Length > 0 && rcp.Length < rcp.TotalSize {
+		rcp.TotalSize = rcp.Length
+		rcp.limit = rcp.Length
+	}
+	if rcp.Offset == 0 {
+		return nil
+	}
+	if rcp.Direct && rcp.Offset%blockAlign != 0 {
+		return ErrDirectOffset
+	}
+	_, err := f.Seek(rcp.Offset, io.SeekStart)
+	return err
+}
+
+// chunkStore returns the directory of the chunks received with --cdc
+func (rcp *Rcp) chunkStore() string {
+	if len(rcp.ChunkStore) > 0 {
+		return rcp.ChunkStore
+	}
+	return filepath.Join(filepath.Dir(rcp.Output), ".rcp-chunks")
+}
+
+// closeWriter closes w after the copy ended with err and returns the error of the transfer.
+// An interrupted output file is kept to resume from, a failed one is dropped,
+// and the listener is told that the sender gave up.
+func (rcp *Rcp) closeWriter(w io.WriteCloser, err error) error {
+	switch w := w.(type) {
+	case *fileWriter:
+		if err == nil {
+			break
+		}
+		if !interrupted(err) {
+			w.abort()
+			if rcp.ack != nil {
+				rcp.ack.drop()
+			}
+			return err
+		}
+		written := w.pos - w.start
+		if rcp.written != nil {
+			written = rcp.written.len()
+		}
+		name, kerr := w.keep()
+		if kerr != nil {
+			return err
+		}
+		if rcp.ack != nil {
+			rcp.ack.keep(name, written)
+		}
+		return &PartialError{Err: err, Name: name, Offset: w.start + written}
+	case *protoWriter:
+		if err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && rcp.ack != nil {
+		rcp.ack.done()
+	}
+	if err == nil && rcp.journal != nil {
+		rcp.journal.remove()
+	}
+	return err
+}
+
+// closeReader closes r, telling the sender when the transfer failed on this side
+func closeReader(r io.ReadCloser, err error) {
+	if pr, ok := r.(*protoReader); ok && err != nil && !errors.Is(err, ErrPeerAborted) {
+		pr.abort()
+		return
+	}
+	r.Close()
+}
+
+// sends reports whether rcp sends the input to a listener
+func (rcp *Rcp) sends() bool {
+	return !rcp.DummyOutput && len(rcp.Output) == 0 && len(rcp.DialAddr) > 0
+}
+
+func (rcp *Rcp) openFile(name string, flag int) (*os.File, error) {
+	if rcp.Direct {
+		return openDirect(name, flag, 0666)
+	}
+	return os.OpenFile(name, flag, 0666)
+}
+
 // ReadWrite mode
-func (rcp *Rcp) ReadWrite() (size int64, err error) {
+func (rcp *Rcp) ReadWrite() (int64, error) {
+	return rcp.ReadWriteContext(context.Background())
+}
+
+// ReadWriteContext runs ReadWrite until the copy completes or ctx is done
+func (rcp *Rcp) ReadWriteContext(ctx context.Context) (int64, error) {
+	rcp.SpeedDashboard = NewSpeedDashboard()
+	rcp.tui = true
+	size, err := rcp.transfer(ctx)
+	return size, classify(err)
+}
+
+// Transfer copies between the endpoints of rcp like ReadWrite, without the terminal
+// dashboard, until the copy completes or ctx is done
+func (rcp *Rcp) Transfer(ctx context.Context) (int64, error) {
+	rcp.SpeedDashboard = newHeadlessDashboard()
+	rcp.tui = false
+	size, err := rcp.transfer(ctx)
+	return size, classify(err)
+}
+
+func (rcp *Rcp) transfer(ctx context.Context) (size int64, err error) {
 	var w io.WriteCloser
 	var r io.ReadCloser
-	rcp.SpeedDashboard = NewSpeedDashboard()
-	r, err = rcp.openReader()
+	if rcp.Direct && rcp.BufSize%blockAlign != 0 {
+		return 0, ErrDirectAlign
+	}
+	if rcp.Checksum && (rcp.ZeroCopy || rcp.Uring || rcp.Writers > 1) {
+		return 0, ErrChecksumMode
+	}
+	if err = rcp.CheckMaxMemory(); err != nil {
+		return 0, err
+	}
+	switch rcp.Fsync {
+	case "":
+		rcp.Fsync = FsyncNone
+	case FsyncNone, FsyncEnd, FsyncInterval:
+	default:
+		return 0, ErrFsync
+	}
+	if rcp.FsyncInterval <= 0 {
+		rcp.FsyncInterval = time.Second
+	}
+	if len(rcp.Checkpoint) > 0 && rcp.sends() {
+		if err = rcp.openJournal(); err != nil {
+			return
+		}
+	}
+	rcp.written = newPrefix()
+	start := time.Now()
+	if rcp.Checksum {
+		rcp.hash = sha256.New()
+	}
+	if len(rcp.ReportFile) > 0 {
+		defer func() {
+			if rerr := rcp.writeReport(start, size, err); rerr != nil && err == nil {
+				err = rerr
+			}
+		}()
+	}
+	defer func() {
+		if rcp.MetricsLinger <= 0 {
+			rcp.stopServers()
+		}
+	}()
+	var prom *promTransfer
+	if len(rcp.MetricsAddr) > 0 {
+		exporter := NewPromExporter()
+		rcp.servers = append(rcp.servers, startServer("metrics", rcp.MetricsAddr, exporter))
+		// visible while the listener waits for the sender
+		file := rcp.Input
+		if len(file) == 0 {
+			file = rcp.Output
+		}
+		prom = exporter.transfer(rcp.DialAddr, file, rcp.TotalSize)
+		defer func() { prom.Done(err) }()
+	}
+	var web *webTransfer
+	if len(rcp.WebAddr) > 0 {
+		rcp.web = NewWebDashboard()
+		rcp.servers = append(rcp.servers, startServer("web", rcp.WebAddr, rcp.web))
+		web = rcp.web.transfer(rcp.Input, rcp.Output, rcp.TotalSize)
+		defer func() { web.Done(err) }()
+	}
+	r, err = rcp.openReader(ctx)
 	if err != nil {
 		return
 	}
-	defer r.Close()
-	w, err = rcp.openWriter()
+	defer func() { closeReader(r, err) }()
+	w, err = rcp.openWriter(ctx)
 	if err != nil {
 		return
 	}
-	defer w.Close()
-	return map[bool]func(io.Writer, io.Reader) (int64, error){
-		true:  io.Copy,
-		false: rcp.bufCopy,
-	}[rcp.SingleThread](w, r)
+	defer func() { err = rcp.closeWriter(w, err) }()
+	if prom != nil {
+		prom.describe(rcp.peer, rcp.file, rcp.TotalSize)
+		rcp.Observers = append(rcp.Observers, prom)
+	}
+	if web != nil {
+		web.describe(rcp.InputName, rcp.OutputName, rcp.TotalSize)
+		rcp.Observers = append(rcp.Observers, web)
+	}
+	if len(rcp.RecordFile) > 0 {
+		var f *os.File
+		if f, err = os.Create(rcp.RecordFile); err != nil {
+			return
+		}
+		defer f.Close()
+		rcp.Observers = append(rcp.Observers, NewRecorder(f, rcp.InputName, rcp.OutputName, rcp.TotalSize))
+	}
+	defer func() {
+		for _, o := range rcp.Observers {
+			o.Done(err)
+		}
+	}()
+	start = time.Now()
+	switch {
+	case rcp.SingleThread:
+		var dst io.Writer = w
+		if rcp.hash != nil {
+			dst = io.MultiWriter(w, rcp.hash)
+		}
+		var src io.Reader = r
+		if rcp.limit > 0 {
+			src = io.LimitReader(r, rcp.limit)
+		}
+		size, err = io.Copy(&prefixWriter{w: dst, written: rcp.written}, src)
+	case rcp.ZeroCopy:
+		size, err = rcp.zeroCopy(ctx, w, r)
+	default:
+		size, err = rcp.bufCopy(ctx, w, r)
+	}
+	if err == nil && rcp.TotalSize > 0 && size < rcp.TotalSize {
+		err = fmt.Errorf("%w: %d of %d bytes", ErrShortTransfer, size, rcp.TotalSize)
+	}
+	if pr, ok := r.(*protoReader); ok && err == nil && pr.end >= 0 && pr.start+size != pr.end {
+		// the sender announced a different count than the header, or sent a stream of unknown size
+		err = fmt.Errorf("%w: %d of %d bytes", ErrShortTransfer, pr.start+size, pr.end)
+	}
+	if pw, ok := w.(*protoWriter); ok && err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		err = pw.peerAborted(err)
+	}
+	return
+}
+
+// Linger keeps serving MetricsAddr and WebAddr for MetricsLinger after the transfer, or until ctx is done,
+// so that its final state can be scraped and shown
+func (rcp *Rcp) Linger(ctx context.Context) {
+	if len(rcp.servers) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Serving the final metrics for %s, interrupt to exit now\n", rcp.MetricsLinger)
+	t := time.NewTimer(rcp.MetricsLinger)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	rcp.stopServers()
+}
+
+// stopServers shuts down the servers of MetricsAddr and WebAddr, after the last events of the web dashboard
+func (rcp *Rcp) stopServers() {
+	if rcp.web != nil {
+		rcp.web.close()
+	}
+	for _, srv := range rcp.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		if srv.Shutdown(ctx) != nil {
+			srv.Close()
+		}
+		cancel()
+	}
+	rcp.servers = nil
+}
+
+func startServer(name, addr string, h http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: h}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "%s server err: %s\n", name, err)
+		}
+	}()
+	return srv
 }
 
 type buffers struct {
-	limit chan struct{}
-	pool  sync.Pool
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int
+	max    int
+	used   int  // buffers handed out
+	mapped bool // the buffers are slices of a mapping, only their count is limited
+	closed bool // the copy was cancelled, Get returns nil
+	pool   sync.Pool
+
+	// since the last resize
+	peak   int           // most buffers handed out
+	gets   int           // buffers handed out
+	waited time.Duration // time Get waited for a buffer
 }
 
 func newBuffers(size, n int) *buffers {
-	bs := buffers{}
-	bs.limit = make(chan struct{}, n)
-	bs.pool = sync.Pool{New: func() interface{} {
-		buf := make([]byte, size)
-		return &buf
-	}}
-	return &bs
+	bs := &buffers{size: size, max: n}
+	bs.cond = sync.NewCond(&bs.mu)
+	return bs
+}
+
+// alignedBlock allocates a buffer aligned to blockAlign for direct I/O
+func alignedBlock(size int) []byte {
+	b := make([]byte, size+blockAlign)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) & (blockAlign - 1)); rem != 0 {
+		off = blockAlign - rem
+	}
+	return b[off : off+size : off+size]
+}
+
+func isAligned(b []byte) bool {
+	return len(b) > 0 && uintptr(unsafe.Pointer(&b[0]))&(blockAlign-1) == 0
+}
+
+// mapInput makes Get return empty buffers for slices of a mapped input
+func (bs *buffers) mapInput() {
+	bs.mu.Lock()
+	bs.mapped = true
+	bs.mu.Unlock()
 }
 
 func (bs *buffers) Len() int {
-	return len(bs.limit)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.used
+}
+
+// bufSize returns the size of the buffers handed out now
+func (bs *buffers) bufSize() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.size
+}
+
+// resize sets the size and the number of the buffers handed out from now on
+func (bs *buffers) resize(size, n int) {
+	bs.mu.Lock()
+	bs.size, bs.max = size, n
+	bs.peak, bs.gets, bs.waited = bs.used, 0, 0
+	bs.cond.Broadcast()
+	bs.mu.Unlock()
 }
 
+// cancel wakes the callers of Get waiting for a buffer, Get returns nil from now on
+func (bs *buffers) cancel() {
+	bs.mu.Lock()
+	bs.closed = true
+	bs.cond.Broadcast()
+	bs.mu.Unlock()
+}
+
+// bufferUsage size and number of the buffers and how they were used since the last resize
+type bufferUsage struct {
+	size, max, peak, gets int
+	waited                time.Duration
+}
+
+func (bs *buffers) usage() bufferUsage {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bufferUsage{bs.size, bs.max, bs.peak, bs.gets, bs.waited}
+}
+
+// Get returns a buffer, or nil once the copy is cancelled
 func (bs *buffers) Get() *[]byte {
-	bs.limit <- struct{}{} // 空くまで待つ
-	return bs.pool.Get().(*[]byte)
+	bs.mu.Lock()
+	if bs.used >= bs.max && !bs.closed {
+		start := time.Now()
+		for bs.used >= bs.max && !bs.closed {
+			bs.cond.Wait() // 空くまで待つ
+		}
+		bs.waited += time.Since(start)
+	}
+	if bs.closed {
+		bs.mu.Unlock()
+		return nil
+	}
+	bs.used++
+	bs.gets++
+	if bs.peak < bs.used {
+		bs.peak = bs.used
+	}
+	size, mapped := bs.size, bs.mapped
+	bs.mu.Unlock()
+	if mapped {
+		return new([]byte)
+	}
+	buf, _ := bs.pool.Get().(*[]byte)
+	if buf == nil || cap(*buf) != size {
+		// buffers of an earlier size are dropped
+		b := alignedBlock(size)
+		buf = &b
+	}
+	*buf = (*buf)[:cap(*buf)]
+	return buf
 }
 
 func (bs *buffers) Put(b *[]byte) {
-	bs.pool.Put(b)
-	<-bs.limit // 解放
+	bs.mu.Lock()
+	keep := !bs.mapped && cap(*b) == bs.size
+	bs.used--
+	bs.cond.Signal() // 解放
+	bs.mu.Unlock()
+	if keep {
+		bs.pool.Put(b)
+	}
+}
+
+// chunk a buffer, or a hole of zeros without a buffer, and its offset from the start of the stream
+type chunk struct {
+	buf  *[]byte
+	off  int64
+	hole int64
+}
+
+func (ch chunk) len() int64 {
+	if ch.buf == nil {
+		return ch.hole
+	}
+	return int64(len(*ch.buf))
 }
 
 type threadCopy struct {
-	queue   chan *[]byte
+	queue   chan chunk
 	bufSize int
 	bs      *buffers
 	r       io.Reader
 	w       io.Writer
+	hash    io.Writer
+
+	observers []Observer
+	adaptive  *adaptiveBuffers
+	written   *prefix
+	reconnect reconnector
+	ack       acknowledger
+	wire      wireCounter
+	total     int64
+	limit     int64
+	window    time.Duration
+	metrics   Metrics
+
+	queueDepth int
+	mmap       bool
+	fill       bool
+	readers    int
+	writers    int
+	sparse     bool
 
 	// atomic counter
-	inputBytes  uint64
-	outputBytes uint64
+	inputBytes   uint64
+	outputBytes  uint64
+	skippedBytes uint64
+}
+
+// inputEnd returns where reading a file of size bytes from start ends
+func (tc *threadCopy) inputEnd(start, size int64) int64 {
+	if tc.limit > 0 && start+tc.limit < size {
+		return start + tc.limit
+	}
+	return size
 }
 
 type result struct {
@@ -149,37 +916,244 @@ type result struct {
 	err  error
 }
 
-func (rcp *Rcp) bufCopy(w io.Writer, r io.Reader) (int64, error) {
-	tc := &threadCopy{
+// uringDepth returns the io_uring requests in flight, 0 without io_uring
+func (rcp *Rcp) uringDepth() int {
+	if !rcp.Uring {
+		return 0
+	}
+	if rcp.QueueDepth > rcp.MaxBufNum {
+		return rcp.MaxBufNum
+	}
+	return rcp.QueueDepth
+}
+
+// CheckMaxMemory returns ErrMaxMemory when MaxMemory cannot hold the fewest buffers of the transfer
+func (rcp *Rcp) CheckMaxMemory() error {
+	if rcp.MaxMemory <= 0 {
+		return nil
+	}
+	a := newAdaptiveBuffers(rcp.MaxMemory, rcp.uringDepth())
+	if min := a.minBudget(); rcp.MaxMemory < min {
+		return fmt.Errorf("%w: %d bytes, it needs at least %d for %d buffers of %d", ErrMaxMemory, rcp.MaxMemory, min, a.minNum, minAdaptiveBuf)
+	}
+	return nil
+}
+
+func (rcp *Rcp) newThreadCopy(w io.Writer, r io.Reader) *threadCopy {
+	queueDepth := rcp.uringDepth()
+	size, num, queued := rcp.BufSize, rcp.MaxBufNum, rcp.MaxBufNum
+	var adaptive *adaptiveBuffers
+	if rcp.MaxMemory > 0 {
+		adaptive = newAdaptiveBuffers(rcp.MaxMemory, queueDepth)
+		size, num = adaptive.initial()
+		queued = adaptive.maxNum()
+	}
+	if rcp.written == nil {
+		rcp.written = newPrefix()
+	}
+	var ack acknowledger
+	if pw, ok := w.(*protoWriter); ok && pw.acks != nil {
+		ack = pw
+	}
+	var reconnect reconnector
+	if rc, ok := r.(reconnector); ok {
+		reconnect = rc
+	} else if rc, ok := w.(reconnector); ok {
+		reconnect = rc
+	}
+	return &threadCopy{
 		w:       w,
 		r:       r,
-		bufSize: rcp.BufSize,
-		bs:      newBuffers(rcp.BufSize, rcp.MaxBufNum),
-		queue:   make(chan *[]byte, rcp.MaxBufNum),
+		hash:    rcp.hash,
+		bufSize: size,
+		bs:      newBuffers(size, num),
+		queue:   make(chan chunk, queued),
+
+		observers: rcp.Observers,
+		adaptive:  adaptive,
+		written:   rcp.written,
+		reconnect: reconnect,
+		ack:       ack,
+		wire:      rcp.wire,
+		total:     rcp.TotalSize,
+		limit:     rcp.limit,
+		window:    rcp.SpeedWindow,
+
+		queueDepth: queueDepth,
+		mmap:       rcp.Mmap,
+		fill:       rcp.Direct,
+		readers:    rcp.Readers,
+		writers:    rcp.Writers,
+		sparse:     rcp.Sparse,
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	rResChan := make(chan result)
-	wResChan := make(chan result)
+}
+
+type copyFunc func(ctx context.Context, wg *sync.WaitGroup) (int64, error)
+
+// monitoredCopy runs fn while the monitor and the dashboard watch the counters of tc
+func (rcp *Rcp) monitoredCopy(ctx context.Context, tc *threadCopy, fn copyFunc) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	var wg sync.WaitGroup
-	defer func() { cancel(); wg.Wait() }()
-	wg.Add(2)
-	go func() { tc.readWorker(ctx, rResChan); wg.Done() }()
-	go func() { tc.writeWorker(ctx, wResChan); wg.Done() }()
+	defer func() { cancel(); wg.Wait(); rcp.Metrics = tc.metrics }()
 
 	mctx, mCancel := context.WithCancel(ctx)
-	wg.Add(2)
+	wg.Add(1)
 	go func() { tc.monitorWorker(mctx, rcp.Ch); wg.Done() }()
+	if rcp.tui {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rcp.SpeedDashboard.Run(mctx); err != nil {
+				// no terminal: carry on without the dashboard
+				fmt.Fprintf(os.Stderr, "SpeedDashboard.Run err: %s\n", err)
+				for {
+					select {
+					case <-rcp.Ch:
+					case <-mctx.Done():
+						return
+					}
+				}
+			}
+			cancel()
+		}()
+	}
+	done := make(chan struct{})
+	wg.Add(1)
 	go func() {
-		if err := rcp.SpeedDashboard.Run(mctx); err != nil {
-			fmt.Fprintf(os.Stderr, "SpeedDashboard.Run err: %s", err)
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			tc.interrupt()
+		case <-done:
 		}
-		wg.Done()
-		cancel()
 	}()
-	rRes := <-rResChan
-	wRes := <-wResChan
+	n, err := fn(ctx, &wg)
+	close(done)
+	if err != nil && ctx.Err() != nil {
+		// the workers were woken up by the cancellation
+		err = ctx.Err()
+	}
 	mCancel()
-	if rRes.err != nil && rRes.err != io.EOF {
+	return n, err
+}
+
+// deadliner a connection whose blocked reads and writes can be interrupted
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interrupter an endpoint that wakes its blocked reads and writes itself
+type interrupter interface {
+	interrupt()
+}
+
+// interruptible reports whether interrupt wakes a read blocked on tc.r
+func (tc *threadCopy) interruptible() bool {
+	switch tc.r.(type) {
+	case interrupter, deadliner:
+		return true
+	}
+	return false
+}
+
+// interrupt wakes the workers waiting for a buffer or blocked on a connection
+func (tc *threadCopy) interrupt() {
+	tc.bs.cancel()
+	for _, c := range []interface{}{tc.r, tc.w} {
+		switch c := c.(type) {
+		case interrupter:
+			c.interrupt()
+		case deadliner:
+			c.SetDeadline(time.Now())
+		}
+	}
+}
+
+func (rcp *Rcp) bufCopy(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	tc := rcp.newThreadCopy(w, r)
+	return rcp.monitoredCopy(ctx, tc, tc.bufCopy)
+}
+
+func (rcp *Rcp) zeroCopy(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	tc := rcp.newThreadCopy(w, r)
+	var fn copyFunc
+	if tc.hash == nil && !tc.sparse {
+		fn = tc.zeroCopyFunc()
+	}
+	if fn == nil {
+		fmt.Fprintln(os.Stderr, "zero-copy is not available for these endpoints, using buffered copy")
+		fn = tc.bufCopy
+	}
+	return rcp.monitoredCopy(ctx, tc, fn)
+}
+
+func (tc *threadCopy) bufCopy(ctx context.Context, wg *sync.WaitGroup) (int64, error) {
+	rResChan := make(chan result, 1)
+	wResChan := make(chan result)
+	readWorker, writeWorker := tc.readWorker, tc.writeWorker
+	// the zero check and the checksum need the sequential workers
+	if tc.readers > 1 && !tc.sparse {
+		if rw := tc.parallelReadWorker(); rw != nil {
+			readWorker = rw
+		}
+	}
+	if tc.writers > 1 && tc.hash == nil {
+		if ww := tc.parallelWriteWorker(); ww != nil {
+			writeWorker = ww
+		}
+	}
+	if tc.queueDepth > 0 {
+		if rw := tc.uringReadWorker(); rw != nil && !tc.sparse {
+			readWorker = rw
+		}
+		if ww := tc.uringWriteWorker(); ww != nil && tc.hash == nil {
+			writeWorker = ww
+		}
+	}
+	if tc.mmap {
+		rw, unmap := tc.mmapReadWorker()
+		if rw == nil {
+			fmt.Fprintln(os.Stderr, "mmap is not available for this input, using buffered reads")
+		} else {
+			readWorker = rw
+			// the writer is done with the slices of the mapping once bufCopy returns
+			defer unmap()
+		}
+	}
+	// a failed writer stops the reader, the writer drains the queue of a failed reader
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wg.Add(1)
+	go func() { writeWorker(wctx, wResChan); wg.Done() }()
+	// a reader that cannot be interrupted is left behind once ctx is done, it exits when tc.r returns
+	var abandon <-chan struct{}
+	if tc.interruptible() {
+		wg.Add(1)
+		go func() { readWorker(wctx, rResChan); wg.Done() }()
+	} else {
+		abandon = ctx.Done()
+		go readWorker(wctx, rResChan)
+	}
+	var rRes, wRes result
+	for rc, wc := rResChan, wResChan; rc != nil || wc != nil; {
+		select {
+		case rRes = <-rc:
+			rc = nil
+		case <-abandon:
+			rc, abandon = nil, nil
+		case wRes = <-wc:
+			wc = nil
+			if wRes.err != nil && wRes.err != io.EOF {
+				cancel()
+				tc.bs.cancel()
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		// the workers stop without an error or with ctx.Err() when ctx is done
+		return int64(wRes.size), err
+	}
+	if rRes.err != nil && rRes.err != io.EOF && rRes.err != context.Canceled {
 		return int64(rRes.size), rRes.err
 	}
 	if wRes.err != nil && wRes.err != io.EOF {
@@ -193,62 +1167,221 @@ func (tc *threadCopy) readWorker(ctx context.Context, res chan result) {
 	var err error
 	defer close(tc.queue)
 	defer func() { res <- result{size, err}; close(res) }()
+	off := int64(0)
+	data := int64(math.MaxInt64) // bytes up to the next hole or the end of the range
+	if tc.limit > 0 {
+		data = tc.limit
+	}
+	hr, ok := tc.r.(holeReader)
+	if ok {
+		data = 0
+	}
+	send := func(ch chunk) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case tc.queue <- ch:
+			off += ch.len()
+			return true
+		}
+	}
 	for {
+		if hr == nil && data == 0 {
+			err = io.EOF
+			return
+		}
+		if data == 0 {
+			var hole int64
+			if hole, data, err = hr.ReadHole(); err != nil {
+				return
+			}
+			if hole > 0 && !send(chunk{off: off, hole: hole}) {
+				return
+			}
+			continue
+		}
 		var c int
 		buf := tc.bs.Get()
-		c, err = tc.r.Read(*buf)
+		if buf == nil {
+			err = ctx.Err()
+			return
+		}
+		if int64(len(*buf)) > data {
+			*buf = (*buf)[:data]
+		}
+		if tc.fill {
+			// full buffers keep every write but the last aligned
+			c, err = readFull(tc.r, *buf)
+		} else {
+			c, err = tc.r.Read(*buf)
+		}
 		size += uint64(c)
+		data -= int64(c)
 		if err != nil && err != io.EOF {
 			return
 		}
 		*buf = (*buf)[:c]
-		select {
-		case <-ctx.Done():
+		atomic.AddUint64(&tc.inputBytes, uint64(c))
+		ch := chunk{buf: buf, off: off}
+		if tc.sparse && c > 0 && isZero(*buf) {
+			tc.bs.Put(buf)
+			ch = chunk{off: off, hole: int64(c)}
+		}
+		if !send(ch) || err == io.EOF {
 			return
-		case tc.queue <- buf:
-			atomic.AddUint64(&tc.inputBytes, uint64(c))
-			if err == io.EOF {
-				return
-			}
 		}
 	}
 }
 
+// readFull reads until buf is full like io.ReadFull, but returns io.EOF for a short read at the end
+func readFull(r io.Reader, buf []byte) (n int, err error) {
+	for n < len(buf) && err == nil {
+		var c int
+		c, err = r.Read(buf[n:])
+		n += c
+	}
+	return
+}
+
+func isZero(b []byte) bool {
+	for len(b) >= 8 {
+		if *(*uint64)(unsafe.Pointer(&b[0])) != 0 {
+			return false
+		}
+		b = b[8:]
+	}
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (tc *threadCopy) writeWorker(ctx context.Context, res chan result) {
 	size := uint64(0)
 	var err error
 	defer func() { res <- result{size, err}; close(res) }()
+	if tc.bs.mapped {
+		// the checksum, the staging of --direct and the system calls read the slices of the mapping
+		debug.SetPanicOnFault(true)
+		defer recoverFault(&err)
+	}
+	next := int64(0)
+	pending := map[int64]chunk{} // chunks that arrived ahead of next
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case buf, ok := <-tc.queue:
+		case ch, ok := <-tc.queue:
 			if !ok {
 				return
 			}
-			var c int
-			if c, err = tc.w.Write(*buf); err != nil {
-				return
+			pending[ch.off] = ch
+			for ch, ok := pending[next]; ok; ch, ok = pending[next] {
+				delete(pending, next)
+				var c int64
+				if c, err = tc.write(ch); err != nil {
+					return
+				}
+				size += uint64(c)
+				next += c
 			}
-			atomic.AddUint64(&tc.outputBytes, uint64(c))
-			tc.bs.Put(buf)
-			size += uint64(c)
 		}
 	}
 }
 
+// write writes a chunk in order to tc.w and tc.hash
+func (tc *threadCopy) write(ch chunk) (int64, error) {
+	if ch.buf == nil {
+		if err := tc.writeHole(ch.hole); err != nil {
+			return 0, err
+		}
+		atomic.AddUint64(&tc.skippedBytes, uint64(ch.hole))
+		tc.written.add(ch.off, ch.hole)
+		return ch.hole, nil
+	}
+	c, err := tc.w.Write(*ch.buf)
+	if err != nil {
+		return int64(c), err
+	}
+	if tc.hash != nil {
+		tc.hash.Write(*ch.buf)
+	}
+	atomic.AddUint64(&tc.outputBytes, uint64(c))
+	tc.written.add(ch.off, int64(c))
+	tc.bs.Put(ch.buf)
+	return int64(c), nil
+}
+
+var zeroBlock = make([]byte, 64*1024)
+
+// writeHole skips n bytes when tc.w can, or writes zeros
+func (tc *threadCopy) writeHole(n int64) error {
+	hw, skip := tc.w.(holeWriter)
+	if skip {
+		if err := hw.WriteHole(n); err != nil {
+			return err
+		}
+		if tc.hash == nil {
+			return nil
+		}
+	}
+	for n > 0 {
+		b := zeroBlock
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		if !skip {
+			if _, err := tc.w.Write(b); err != nil {
+				return err
+			}
+		}
+		if tc.hash != nil {
+			tc.hash.Write(b)
+		}
+		n -= int64(len(b))
+	}
+	return nil
+}
+
 func (tc *threadCopy) monitorWorker(ctx context.Context, ch chan<- Metrics) {
 	start := time.Now()
 	prevTime := start
 	oldInputBytes := uint64(0)
 	oldOutputBytes := uint64(0)
 	m := Metrics{}
-	speedCalcFunc := func(t time.Time) {
+	window := newSpeedWindow(tc.window)
+	window.add(start, 0)
+	alpha := ewmaAlpha(tc.window)
+	speeds := []uint64{}
+	progressCalcFunc := func(t time.Time) {
 		dur := t.Sub(start)
-		inputBytes := atomic.LoadUint64(&tc.inputBytes)
+		m.Elapsed = dur
 		outputBytes := atomic.LoadUint64(&tc.outputBytes)
-		m.Size = uint64(outputBytes)
+		m.SkippedBytes = atomic.LoadUint64(&tc.skippedBytes)
+		m.Size = outputBytes + m.SkippedBytes
 		m.AvgByteSec = uint64(float64(outputBytes) / dur.Seconds())
+		if tc.wire != nil {
+			m.WireBytes = tc.wire.wireBytes()
+			m.WireByteSec = uint64(float64(m.WireBytes) / dur.Seconds())
+		}
+		if tc.reconnect != nil {
+			n, down := tc.reconnect.reconnects()
+			m.Reconnects, m.Downtime = uint64(n), down
+		}
+		if tc.ack != nil {
+			m.Acknowledged = uint64(tc.ack.acknowledged())
+		}
+		m.BufferUsed = uint64(len(tc.queue) * tc.bs.bufSize())
+		if m.BufferMaxUsed < m.BufferUsed {
+			m.BufferMaxUsed = m.BufferUsed
+		}
+	}
+	speedCalcFunc := func(t time.Time) {
+		progressCalcFunc(t)
+		inputBytes := atomic.LoadUint64(&tc.inputBytes)
+		outputBytes := atomic.LoadUint64(&tc.outputBytes)
 		m.InputByteSec = uint64(float64(inputBytes-oldInputBytes) / t.Sub(prevTime).Seconds())
 		if m.InputMaxByteSec < m.InputByteSec {
 			m.InputMaxByteSec = m.InputByteSec
@@ -259,13 +1392,19 @@ func (tc *threadCopy) monitorWorker(ctx context.Context, ch chan<- Metrics) {
 			m.OutputMaxByteSec = m.OutputByteSec
 		}
 		oldOutputBytes = outputBytes
-		m.BufferUsed = uint64(len(tc.queue) * tc.bufSize)
-		if m.BufferMaxUsed < m.BufferUsed {
-			m.BufferMaxUsed = m.BufferUsed
-		}
+		m.WindowByteSec = window.add(t, outputBytes)
+		m.EWMAByteSec = ewma(m.EWMAByteSec, m.OutputByteSec, alpha, len(speeds) == 0)
+		m.ETA = eta(tc.total, m.Size, m.WindowByteSec)
+		speeds = append(speeds, m.OutputByteSec)
 		prevTime = t
 	}
 	postFunc := func() {
+		for _, o := range tc.observers {
+			o.Observe(m)
+		}
+		if ch == nil {
+			return
+		}
 		select {
 		case ch <- m:
 		case <-ctx.Done():
@@ -276,9 +1415,25 @@ func (tc *threadCopy) monitorWorker(ctx context.Context, ch chan<- Metrics) {
 	for {
 		select {
 		case <-ctx.Done():
+			if len(speeds) == 0 {
+				speedCalcFunc(time.Now()) // finished within the first interval
+			} else {
+				progressCalcFunc(time.Now())
+			}
+			m.ETA = 0
+			m.MinByteSec, m.P50ByteSec, m.P95ByteSec = speedSummary(speeds)
+			for _, o := range tc.observers {
+				o.Observe(m)
+			}
+			tc.metrics = m
 			return
 		case t := <-ticker.C:
 			speedCalcFunc(t)
+			if tc.adaptive != nil {
+				tc.adaptive.adapt(tc.bs, m, len(tc.queue))
+				u := tc.bs.usage()
+				m.BufferLimit = uint64(u.size) * uint64(u.max)
+			}
 			postFunc()
 		}
 	}
@@ -0,0 +1,127 @@
+package rcp
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var recordHeader = []string{
+	"elapsed_sec", "bytes", "total_bytes", "avg_byte_sec",
+	"input_byte_sec", "input_max_byte_sec", "output_byte_sec", "output_max_byte_sec",
+	"buffer_used", "buffer_max_used", "window_byte_sec", "ewma_byte_sec", "eta_sec",
+	"input", "output",
+}
+
+// ErrRecord error type of a malformed metrics record
+var ErrRecord = errors.New("malformed metrics record")
+
+// Recording metrics samples of a recorded transfer
+type Recording struct {
+	InputName  string
+	OutputName string
+	TotalSize  int64
+	Samples    []Metrics
+}
+
+type recorder struct {
+	w     *csv.Writer
+	names []string
+	total int64
+	err   error
+}
+
+// NewRecorder returns an Observer writing every metrics sample to w as CSV
+func NewRecorder(w io.Writer, inputName, outputName string, total int64) Observer {
+	rec := &recorder{w: csv.NewWriter(w), names: []string{inputName, outputName}, total: total}
+	rec.err = rec.w.Write(recordHeader)
+	return rec
+}
+
+func (rec *recorder) Observe(m Metrics) {
+	if rec.err != nil {
+		return
+	}
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	row := []string{
+		strconv.FormatFloat(m.Elapsed.Seconds(), 'f', 3, 64), u(m.Size), strconv.FormatInt(rec.total, 10), u(m.AvgByteSec),
+		u(m.InputByteSec), u(m.InputMaxByteSec), u(m.OutputByteSec), u(m.OutputMaxByteSec),
+		u(m.BufferUsed), u(m.BufferMaxUsed), u(m.WindowByteSec), u(m.EWMAByteSec),
+		strconv.FormatFloat(m.ETA.Seconds(), 'f', 0, 64),
+	}
+	rec.err = rec.w.Write(append(row, rec.names...))
+	rec.w.Flush()
+}
+
+func (rec *recorder) Done(err error) { rec.w.Flush() }
+
+// ReadRecording reads metrics samples written by NewRecorder
+func ReadRecording(r io.Reader) (*Recording, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(recordHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, ErrRecord
+	}
+	rec := &Recording{}
+	for _, row := range rows[1:] {
+		var v [13]float64
+		for i := range v {
+			if v[i], err = strconv.ParseFloat(row[i], 64); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrRecord, err)
+			}
+		}
+		rec.TotalSize = int64(v[2])
+		rec.InputName, rec.OutputName = row[13], row[14]
+		rec.Samples = append(rec.Samples, Metrics{
+			Elapsed:          time.Duration(v[0] * float64(time.Second)),
+			Size:             uint64(v[1]),
+			AvgByteSec:       uint64(v[3]),
+			InputByteSec:     uint64(v[4]),
+			InputMaxByteSec:  uint64(v[5]),
+			OutputByteSec:    uint64(v[6]),
+			OutputMaxByteSec: uint64(v[7]),
+			BufferUsed:       uint64(v[8]),
+			BufferMaxUsed:    uint64(v[9]),
+			WindowByteSec:    uint64(v[10]),
+			EWMAByteSec:      uint64(v[11]),
+			ETA:              time.Duration(v[12]) * time.Second,
+		})
+	}
+	return rec, nil
+}
+
+// Replay renders the recording in the speed dashboard, speed times faster than recorded
+func (rec *Recording) Replay(ctx context.Context, s *SpeedDashboard, speed float64) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	s.InputName, s.OutputName, s.TotalSize = rec.InputName, rec.OutputName, rec.TotalSize
+	s.Interval = time.Duration(float64(time.Second) / speed)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for _, m := range rec.Samples {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case s.Ch <- m:
+			}
+		}
+	}()
+	return s.Run(ctx)
+}
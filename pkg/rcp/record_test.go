@@ -0,0 +1,86 @@
+package rcp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingRoundTrip(t *testing.T) {
+	sample := func(i int) Metrics {
+		n := uint64(i)
+		return Metrics{
+			Elapsed: time.Duration(i)*time.Second + 250*time.Millisecond, Size: n * 1000, AvgByteSec: n * 100,
+			InputByteSec: n*100 + 1, InputMaxByteSec: n*100 + 2, OutputByteSec: n*100 + 3, OutputMaxByteSec: n*100 + 4,
+			BufferUsed: n + 5, BufferMaxUsed: n + 6, WindowByteSec: n*100 + 7, EWMAByteSec: n*100 + 8,
+			ETA: time.Duration(60-i) * time.Second,
+		}
+	}
+	many := make([]Metrics, 100)
+	for i := range many {
+		many[i] = sample(i)
+	}
+	tests := []struct {
+		name          string
+		input, output string
+		total         int64
+		samples       []Metrics
+	}{
+		{"one", "in.bin", "out.bin", 1000, []Metrics{sample(1)}},
+		{"size not known", "-", "-", 0, []Metrics{sample(1), sample(2)}},
+		{"quoted names", `a,"b"`, "c\nd", 1 << 40, []Metrics{sample(3)}},
+		{"large values", "in", "out", 1 << 50, []Metrics{{Size: 1 << 50, AvgByteSec: 1 << 40, ETA: time.Hour}}},
+		{"many", "in", "out", 100000, many},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			rec := NewRecorder(&buf, tt.input, tt.output, tt.total)
+			for _, m := range tt.samples {
+				rec.Observe(m)
+			}
+			rec.Done(nil)
+			got, err := ReadRecording(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.InputName != tt.input || got.OutputName != tt.output || got.TotalSize != tt.total {
+				t.Fatalf("ReadRecording() = %q, %q, %d, want %q, %q, %d",
+					got.InputName, got.OutputName, got.TotalSize, tt.input, tt.output, tt.total)
+			}
+			if !reflect.DeepEqual(got.Samples, tt.samples) {
+				t.Fatalf("ReadRecording() = %+v, want %+v", got.Samples, tt.samples)
+			}
+		})
+	}
+}
+
+func TestReadRecordingInvalid(t *testing.T) {
+	header := strings.Join(recordHeader, ",") + "\n"
+	row := "1.000,100,1000,100,1,2,3,4,5,6,7,8,9,in,out\n"
+	tests := []struct {
+		name   string
+		csv    string
+		record bool // ErrRecord rather than an error of the CSV
+	}{
+		{"empty", "", true},
+		{"header only", header, true},
+		{"not a number", header + strings.Replace(row, "100", "x", 1), true},
+		{"missing field", header + "1.000,100,in,out\n", false},
+		{"extra field", header + strings.TrimSuffix(row, "\n") + ",extra\n", false},
+	}
+	if _, err := ReadRecording(strings.NewReader(header + row)); err != nil {
+		t.Fatalf("ReadRecording() of a valid row: %s", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadRecording(strings.NewReader(tt.csv))
+			if err == nil || errors.Is(err, ErrRecord) != tt.record {
+				t.Fatalf("ReadRecording() error = %v, want ErrRecord %v", err, tt.record)
+			}
+		})
+	}
+}
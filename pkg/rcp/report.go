@@ -0,0 +1,72 @@
+package rcp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Report structured record of a finished transfer
+type Report struct {
+	Input            string    `json:"input"`
+	Output           string    `json:"output"`
+	Peer             string    `json:"peer,omitempty"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	Bytes            int64     `json:"bytes"`
+	TotalSize        int64     `json:"totalSize"`
+	SkippedBytes     uint64    `json:"skippedBytes"`
+	NetworkBytes     uint64    `json:"networkBytes,omitempty"`
+	DurationSec      float64   `json:"durationSec"`
+	AvgByteSec       uint64    `json:"avgByteSec"`
+	InputMaxByteSec  uint64    `json:"inputMaxByteSec"`
+	OutputMaxByteSec uint64    `json:"outputMaxByteSec"`
+	BufferMaxUsed    uint64    `json:"bufferMaxUsed"`
+	Checksum         string    `json:"checksum,omitempty"`
+	Retries          int       `json:"retries"`
+	Error            string    `json:"error,omitempty"`
+}
+
+func (rcp *Rcp) report(start, end time.Time, size int64, err error) Report {
+	r := Report{
+		Input:            rcp.InputName,
+		Output:           rcp.OutputName,
+		Peer:             rcp.peer,
+		Start:            start,
+		End:              end,
+		Bytes:            size,
+		TotalSize:        rcp.TotalSize,
+		SkippedBytes:     rcp.SkippedBytes,
+		NetworkBytes:     rcp.WireBytes,
+		DurationSec:      end.Sub(start).Seconds(),
+		InputMaxByteSec:  rcp.InputMaxByteSec,
+		OutputMaxByteSec: rcp.OutputMaxByteSec,
+		BufferMaxUsed:    rcp.BufferMaxUsed,
+		Retries:          int(rcp.Reconnects),
+	}
+	if r.DurationSec > 0 {
+		r.AvgByteSec = uint64(float64(size) / r.DurationSec)
+	}
+	r.Checksum = rcp.Sum()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// Sum returns the SHA-256 of the data copied with Checksum, empty without it
+func (rcp *Rcp) Sum() string {
+	if rcp.hash == nil {
+		return ""
+	}
+	return "sha256:" + hex.EncodeToString(rcp.hash.Sum(nil))
+}
+
+func (rcp *Rcp) writeReport(start time.Time, size int64, err error) error {
+	b, merr := json.MarshalIndent(rcp.report(start, time.Now(), size, err), "", "  ")
+	if merr != nil {
+		return merr
+	}
+	return os.WriteFile(rcp.ReportFile, append(b, '\n'), 0644)
+}
@@ -0,0 +1,100 @@
+package rcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// partSuffix is appended to the name of an interrupted output kept to resume the transfer
+const partSuffix = ".part"
+
+// PartialError error type of an interrupted transfer whose output is complete up to Offset
+type PartialError struct {
+	Err    error
+	Name   string // the output holding the bytes written
+	Offset int64  // the first Offset bytes of Name are complete
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%s: %s is complete up to %d", e.Err, e.Name, e.Offset)
+}
+
+// Unwrap returns the error that interrupted the transfer
+func (e *PartialError) Unwrap() error { return e.Err }
+
+// recoverFault turns the fault of a read past the end of a truncated mapping into an error,
+// like the EFAULT of a system call writing from it
+func recoverFault(err *error) {
+	if r := recover(); r != nil {
+		if _, ok := r.(interface{ Addr() uintptr }); !ok {
+			panic(r)
+		}
+	} else if !errors.Is(*err, syscall.EFAULT) {
+		return
+	}
+	*err = fmt.Errorf("%w: the input was truncated while it was mapped", ErrShortTransfer)
+}
+
+// isRegular reports whether name is an existing regular file
+func isRegular(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// interrupted reports whether err stopped a transfer that can be resumed from what was written
+func interrupted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, ErrPeerAborted) || errors.Is(err, ErrShortTransfer) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// prefix tracks the chunks written out of order to know how much of the start of the output is complete
+type prefix struct {
+	mu   sync.Mutex
+	next int64
+	done map[int64]int64 // offset -> length of the chunks written past next
+}
+
+func newPrefix() *prefix { return &prefix{done: map[int64]int64{}} }
+
+// add records n bytes written at off
+func (p *prefix) add(off, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if off != p.next {
+		p.done[off] = n
+		return
+	}
+	p.next += n
+	for n, ok := p.done[p.next]; ok; n, ok = p.done[p.next] {
+		delete(p.done, p.next)
+		p.next += n
+	}
+}
+
+// len returns the bytes written from the start without a gap
+func (p *prefix) len() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+// prefixWriter records the bytes written sequentially to w
+type prefixWriter struct {
+	w       io.Writer
+	written *prefix
+	off     int64
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written.add(pw.off, int64(n))
+	pw.off += int64(n)
+	return n, err
+}
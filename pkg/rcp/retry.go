@@ -0,0 +1,346 @@
+package rcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	retryDialTimeout = 10 * time.Second
+	maxRetryBackoff  = time.Minute
+)
+
+// ErrRetry error type of --retries without an input to send again
+var ErrRetry = errors.New("The --retries mode needs an input file or --dummyInput and cannot be combined with --delta or --cdc")
+
+// reconnector counts the reconnections of a connection and the time it was down
+type reconnector interface {
+	reconnects() (int, time.Duration)
+}
+
+// reconnectStats reconnections of a connection, read by the monitor
+type reconnectStats struct {
+	mu       sync.Mutex
+	count    int
+	downtime time.Duration
+}
+
+func (s *reconnectStats) add(down time.Duration) {
+	s.mu.Lock()
+	s.count++
+	s.downtime += down
+	s.mu.Unlock()
+}
+
+func (s *reconnectStats) reconnects() (int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.downtime
+}
+
+// retrier redials the listener after a connection failure and sends again what it did not receive
+type retrier struct {
+	ctx     context.Context
+	addr    string
+	dialer  *net.Dialer // with the socket options of the first connection
+	nagle   bool
+	retries int
+	backoff time.Duration
+	src     io.ReaderAt // the input, to send again the bytes lost with the connection
+	base    int64       // offset of the stream in src
+	header  header
+}
+
+// newSession returns a random id that a resumed connection presents to the listener
+func newSession() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// retryWait returns how long the listener waits for the sender to reconnect
+func retryWait(retries int, backoff time.Duration) time.Duration {
+	wait := time.Duration(0)
+	for i := 0; i < retries; i++ {
+		wait += backoff + retryDialTimeout
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	return wait
+}
+
+// zeroReaderAt the --dummyInput sent again after a reconnection
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func putOffset(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+func getOffset(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, ErrProtocol
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// resume redials the listener after err with exponential backoff and sends again what it did not receive
+func (pw *protoWriter) resume(err error) error {
+	r := pw.retry
+	if atomic.LoadInt32(&pw.stopped) != 0 || r.ctx.Err() != nil || errors.Is(err, ErrPeerAborted) {
+		return err
+	}
+	if perr := pw.peerAborted(err); perr == ErrPeerAborted {
+		return perr
+	}
+	down := time.Now()
+	backoff := r.backoff
+	for i := 0; i < r.retries; i++ {
+		select {
+		case <-r.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		if rerr := pw.redial(); rerr != nil {
+			if errors.Is(rerr, ErrResume) {
+				return rerr
+			}
+			err = rerr
+			continue
+		}
+		pw.stats.add(time.Since(down))
+		return nil
+	}
+	return err
+}
+
+// redial connects to the listener again and sends what it did not receive
+func (pw *protoWriter) redial() error {
+	r := pw.retry
+	d := *r.dialer
+	d.Timeout = retryDialTimeout
+	conn, err := d.DialContext(r.ctx, "tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	if r.nagle {
+		setNagle(conn)
+	}
+	h := r.header
+	h.Sent = pw.sent
+	received, err := resumeHandshake(conn, h)
+	switch {
+	case err != nil:
+	case received < 0:
+		// a restarted listener without the checkpoint of the session
+		err = fmt.Errorf("%w: the listener has no checkpoint of session %s", ErrResume, h.Session)
+	case received > pw.sent:
+		err = ErrProtocol
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	pw.swap(conn)
+	return pw.resend(received)
+}
+
+// swap replaces the failed connection
+func (pw *protoWriter) swap(conn net.Conn) {
+	pw.mu.Lock()
+	pw.conn.Close()
+	pw.conn, pw.torn = conn, false
+	if pw.acks != nil {
+		pw.acks = pw.readAcks(conn)
+	}
+	if atomic.LoadInt32(&pw.stopped) != 0 {
+		conn.SetWriteDeadline(time.Now().Add(abortTimeout))
+	}
+	pw.mu.Unlock()
+}
+
+// resend sends the input from off up to where the failed connection was
+func (pw *protoWriter) resend(off int64) error {
+	buf := make([]byte, 1024*1024)
+	for off < pw.sent {
+		n := int64(len(buf))
+		if pw.sent-off < n {
+			n = pw.sent - off
+		}
+		c, err := pw.retry.src.ReadAt(buf[:n], pw.retry.base+off)
+		if int64(c) < n {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if _, err = pw.writeData(buf[:n]); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// resumeHandshake presents the session of h on conn and returns the bytes the listener received
+func resumeHandshake(conn net.Conn, h header) (int64, error) {
+	h.Resume = true
+	b, err := json.Marshal(h)
+	if err != nil {
+		return 0, err
+	}
+	conn.SetDeadline(time.Now().Add(retryDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err = io.WriteString(conn, protoMagic); err != nil {
+		return 0, err
+	}
+	if err = writeMessage(conn, frameHeader, b); err != nil {
+		return 0, err
+	}
+	if b, err = readMessage(conn, frameResume); err != nil {
+		return 0, err
+	}
+	return getOffset(b)
+}
+
+// readResume reads the handshake of a sender resuming a transfer
+func readResume(conn net.Conn, deadline time.Time) (h header, err error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	magic := make([]byte, len(protoMagic))
+	if _, err = io.ReadFull(conn, magic); err != nil {
+		return
+	}
+	if string(magic) != protoMagic {
+		return h, ErrProtocol
+	}
+	b, err := readMessage(conn, frameHeader)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &h)
+	return
+}
+
+// resumable reports whether the listener waits for the sender to reconnect after err
+func (pr *protoReader) resumable(err error) bool {
+	_, ok := pr.rc.(*reciveStream)
+	return ok && pr.header.RetryWait > 0 && pr.end < 0 && atomic.LoadInt32(&pr.stopped) == 0 &&
+		err != io.EOF && !errors.Is(err, ErrPeerAborted) && !errors.Is(err, ErrProtocol)
+}
+
+// resume waits for the sender to reconnect after the connection failed with err,
+// and tells it how much was received
+func (pr *protoReader) resume(err error) error {
+	rs := pr.rc.(*reciveStream)
+	down := time.Now()
+	timer := time.NewTimer(pr.header.RetryWait)
+	defer timer.Stop()
+	for {
+		var conn net.Conn
+		select {
+		case conn = <-rs.resumes:
+		case <-rs.accepting:
+			// interrupted or closed
+			return err
+		case <-timer.C:
+			return err
+		}
+		if werr := writeMessage(conn, frameResume, putOffset(pr.delivered)); werr != nil {
+			conn.Close()
+			continue
+		}
+		rs.swap(conn)
+		pr.remain, pr.hole = 0, 0
+		pr.stats.add(time.Since(down))
+		return nil
+	}
+}
+
+// acceptResumes accepts the connections of the sender resuming session while the current one is read,
+// since a link that drops silently leaves its Read blocked until the keepalive gives up
+func (rs *reciveStream) acceptResumes(session string) {
+	rs.resumes, rs.accepting = make(chan net.Conn), make(chan struct{})
+	rs.peer = rs.conn.RemoteAddr()
+	go func() {
+		defer close(rs.accepting)
+		for {
+			conn, err := rs.ln.Accept()
+			if err != nil {
+				return
+			}
+			go rs.handover(conn, session)
+		}
+	}()
+}
+
+// handover passes conn to resume once it comes from the host of the first connection and presents session,
+// and wakes the Read blocked on the stale connection
+func (rs *reciveStream) handover(conn net.Conn, session string) {
+	if !sameHost(conn.RemoteAddr(), rs.peer) {
+		host, _, _ := net.SplitHostPort(rs.peer.String())
+		fmt.Fprintf(os.Stderr, "Rejected a connection from %s, only %s can resume the transfer\n", conn.RemoteAddr(), host)
+		conn.Close()
+		return
+	}
+	h, err := readResume(conn, time.Now().Add(retryDialTimeout))
+	if err != nil || !h.Resume || h.Session != session {
+		conn.Close()
+		return
+	}
+	if rs.nagle {
+		setNagle(conn)
+	}
+	rs.mu.Lock()
+	rs.conn.SetReadDeadline(time.Now())
+	rs.mu.Unlock()
+	select {
+	case rs.resumes <- conn:
+	case <-rs.closed:
+		conn.Close()
+	}
+}
+
+// sameHost reports whether the addresses a and b have the same IP
+func sameHost(a, b net.Addr) bool {
+	ta, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	tb, ok := b.(*net.TCPAddr)
+	return ok && ta.IP.Equal(tb.IP)
+}
+
+// swap replaces the failed connection
+func (rs *reciveStream) swap(conn net.Conn) {
+	rs.mu.Lock()
+	rs.conn.Close()
+	rs.conn = conn
+	if !rs.deadline.IsZero() {
+		conn.SetDeadline(rs.deadline)
+	}
+	rs.mu.Unlock()
+}
@@ -0,0 +1,197 @@
+package rcp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []byte // frames the listener answers with
+		want   int64
+		err    error
+	}{
+		{"from the start", frame(frameResume, putOffset(0)), 0, nil},
+		{"received", frame(frameResume, putOffset(12345)), 12345, nil},
+		{"no checkpoint", frame(frameResume, putOffset(-1)), -1, nil},
+		{"short offset", frame(frameResume, []byte{1, 2}), 0, ErrProtocol},
+		{"abort", frame(frameAbort, nil), 0, ErrPeerAborted},
+		{"other frame", frame(frameData, putOffset(1)), 0, ErrProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			sent := header{Size: 100, Session: "0123456789abcdef", Sent: 50}
+			got := make(chan header, 1)
+			go func() {
+				defer b.Close()
+				h, err := readResume(b, time.Now().Add(time.Second))
+				if err != nil {
+					got <- header{}
+					return
+				}
+				got <- h
+				b.Write(tt.answer)
+			}()
+			n, err := resumeHandshake(a, sent)
+			if !errors.Is(err, tt.err) || n != tt.want {
+				t.Fatalf("resumeHandshake() = %d, %v, want %d, %v", n, err, tt.want, tt.err)
+			}
+			sent.Resume = true
+			if h := <-got; h != sent {
+				t.Fatalf("the listener read %+v, want %+v", h, sent)
+			}
+		})
+	}
+}
+
+// frame returns the frame typ with payload
+func frame(typ byte, payload []byte) []byte {
+	var buf bytes.Buffer
+	writeMessage(&buf, typ, payload)
+	return buf.Bytes()
+}
+
+func TestSameHost(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		name string
+		a, b net.Addr
+		want bool
+	}{
+		{"same", tcp("192.0.2.1", 1000), tcp("192.0.2.1", 1000), true},
+		{"other port", tcp("192.0.2.1", 1000), tcp("192.0.2.1", 2000), true},
+		{"other ip", tcp("192.0.2.1", 1000), tcp("192.0.2.2", 1000), false},
+		{"v4 in v6", tcp("::ffff:192.0.2.1", 1000), tcp("192.0.2.1", 1000), true},
+		{"v6", tcp("2001:db8::1", 1000), tcp("2001:db8::2", 1000), false},
+		{"not tcp", &net.UnixAddr{Name: "a"}, tcp("192.0.2.1", 1000), false},
+	}
+	for _, tt := range tests {
+		if got := sameHost(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameHost() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// cutConn fails its writes after left bytes, like a connection that drops
+type cutConn struct {
+	net.Conn
+	left int
+}
+
+func (c *cutConn) Write(b []byte) (int, error) {
+	if len(b) <= c.left {
+		c.left -= len(b)
+		return c.Conn.Write(b)
+	}
+	n, _ := c.Conn.Write(b[:c.left])
+	c.left = 0
+	c.Conn.Close()
+	return n, net.ErrClosed
+}
+
+func TestRetryTransfer(t *testing.T) {
+	input := randBytes(9, 3<<20)
+	tests := []struct {
+		name  string
+		cut   int // bytes written after the header before the connection drops, -1 never
+		write int // bytes of each write
+	}{
+		{"no drop", -1, 1 << 20},
+		{"before the data", 0, 1 << 20},
+		{"in a frame header", 3, 1 << 20},
+		{"in a frame", 1000, 1 << 20},
+		{"late", 3<<20 - 100, 64 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			h := header{Size: int64(len(input)), Session: newSession(), RetryWait: 5 * time.Second}
+			sent := make(chan error, 1)
+			go func() {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					sent <- err
+					return
+				}
+				pw, err := newProtoWriter(conn, h)
+				if err != nil {
+					conn.Close()
+					sent <- err
+					return
+				}
+				if tt.cut >= 0 {
+					pw.conn = &cutConn{Conn: conn, left: tt.cut}
+				}
+				pw.retry = &retrier{ctx: ctx, addr: ln.Addr().String(), dialer: &net.Dialer{}, retries: 3,
+					backoff: 10 * time.Millisecond, src: bytes.NewReader(input), header: h}
+				for in := input; len(in) > 0; in = in[tt.write:] {
+					if _, err = pw.Write(in[:tt.write]); err != nil {
+						pw.Close()
+						sent <- err
+						return
+					}
+				}
+				sent <- pw.Close()
+			}()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs := &reciveStream{ln: ln, conn: conn, closed: make(chan struct{})}
+			defer rs.Close()
+			pr, err := newProtoReader(rs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.acceptResumes(pr.header.Session)
+			got, err := io.ReadAll(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = <-sent; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, input) {
+				t.Fatalf("read %d bytes that differ from the %d of the input", len(got), len(input))
+			}
+			want := 1
+			if tt.cut < 0 {
+				want = 0
+			}
+			if n, _ := pr.reconnects(); n != want {
+				t.Fatalf("%d reconnections, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	tests := []struct {
+		retries int
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{0, time.Second, 0},
+		{1, time.Second, time.Second + retryDialTimeout},
+		{3, time.Second, 7*time.Second + 3*retryDialTimeout},
+		{3, 40 * time.Second, 40*time.Second + 2*maxRetryBackoff + 3*retryDialTimeout},
+	}
+	for _, tt := range tests {
+		if got := retryWait(tt.retries, tt.backoff); got != tt.want {
+			t.Errorf("retryWait(%d, %s) = %s, want %s", tt.retries, tt.backoff, got, tt.want)
+		}
+	}
+}
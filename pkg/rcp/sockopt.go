@@ -0,0 +1,32 @@
+package rcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// dialer returns the dialer of the connections to the listener, with the socket options
+func (rcp *Rcp) dialer() *net.Dialer {
+	return &net.Dialer{KeepAlive: rcp.KeepAlive, Control: rcp.control}
+}
+
+// listenConfig returns the config of the listening socket, whose options the accepted connections inherit
+func (rcp *Rcp) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{KeepAlive: rcp.KeepAlive, Control: rcp.control}
+}
+
+// control applies the socket options before the socket connects or listens
+func (rcp *Rcp) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = rcp.setSockopts(fd, network) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setNagle turns off TCP_NODELAY, that Go sets on every connection once it is established
+func setNagle(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(false)
+	}
+}
@@ -0,0 +1,63 @@
+package rcp
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSockopts sets the socket options of rcp on fd
+func (rcp *Rcp) setSockopts(fd uintptr, network string) error {
+	s := int(fd)
+	if rcp.SndBuf > 0 {
+		if err := setBuffer(s, unix.SO_SNDBUFFORCE, unix.SO_SNDBUF, rcp.SndBuf, "wmem_max"); err != nil {
+			return fmt.Errorf("sndbuf: %w", err)
+		}
+	}
+	if rcp.RcvBuf > 0 {
+		if err := setBuffer(s, unix.SO_RCVBUFFORCE, unix.SO_RCVBUF, rcp.RcvBuf, "rmem_max"); err != nil {
+			return fmt.Errorf("rcvbuf: %w", err)
+		}
+	}
+	if len(rcp.Congestion) > 0 {
+		if err := unix.SetsockoptString(s, unix.IPPROTO_TCP, unix.TCP_CONGESTION, rcp.Congestion); err != nil {
+			return fmt.Errorf("congestion control %s: %w", rcp.Congestion, err)
+		}
+	}
+	if rcp.MSS > 0 {
+		if err := unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_MAXSEG, rcp.MSS); err != nil {
+			return fmt.Errorf("mss: %w", err)
+		}
+	}
+	if rcp.TOS > 0 {
+		level, opt := unix.IPPROTO_IP, unix.IP_TOS
+		if network == "tcp6" {
+			level, opt = unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+		}
+		if err := unix.SetsockoptInt(s, level, opt, rcp.TOS); err != nil {
+			return fmt.Errorf("tos: %w", err)
+		}
+	}
+	if rcp.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(s, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(rcp.UserTimeout.Milliseconds())); err != nil {
+			return fmt.Errorf("user timeout: %w", err)
+		}
+	}
+	return nil
+}
+
+// setBuffer sets a socket buffer to size, past net.core.<sysctl> when the process is allowed to
+func setBuffer(s, force, opt, size int, sysctl string) error {
+	if unix.SetsockoptInt(s, unix.SOL_SOCKET, force, size) == nil {
+		return nil
+	}
+	if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, opt, size); err != nil {
+		return err
+	}
+	// the kernel doubles the size for its bookkeeping and caps it at the sysctl
+	if got, err := unix.GetsockoptInt(s, unix.SOL_SOCKET, opt); err == nil && got < size {
+		fmt.Fprintf(os.Stderr, "The socket buffer is limited to %d bytes instead of %d, raise net.core.%s\n", got/2, size, sysctl)
+	}
+	return nil
+}
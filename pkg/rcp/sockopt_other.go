@@ -0,0 +1,14 @@
+//go:build !linux
+
+package rcp
+
+import "errors"
+
+var errSockoptUnsupported = errors.New("the socket buffers, congestion control, MSS, TOS and user timeout are only supported on Linux")
+
+func (rcp *Rcp) setSockopts(fd uintptr, network string) error {
+	if rcp.SndBuf > 0 || rcp.RcvBuf > 0 || len(rcp.Congestion) > 0 || rcp.MSS > 0 || rcp.TOS > 0 || rcp.UserTimeout > 0 {
+		return errSockoptUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package rcp
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sparseReader reads a file and reports its holes found with SEEK_DATA/SEEK_HOLE
+type sparseReader struct {
+	*os.File
+	pos  int64
+	size int64
+}
+
+// newSparseReader reads f from its current position up to end
+func newSparseReader(f *os.File, end int64) (io.ReadCloser, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return f, nil
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if end > fi.Size() {
+		end = fi.Size()
+	}
+	return &sparseReader{File: f, pos: pos, size: end}, nil
+}
+
+func (s *sparseReader) Read(b []byte) (int, error) {
+	n, err := s.File.Read(b)
+	s.pos += int64(n)
+	return n, err
+}
+
+func (s *sparseReader) ReadHole() (hole, data int64, err error) {
+	if s.pos >= s.size {
+		return 0, 0, io.EOF
+	}
+	start, err := unix.Seek(int(s.Fd()), s.pos, unix.SEEK_DATA)
+	switch {
+	case err == unix.ENXIO:
+		// a hole up to the end of the file
+		start = s.size
+	case err != nil:
+		return 0, 0, err
+	case start > s.size:
+		start = s.size
+	}
+	end := s.size
+	if start < s.size {
+		if end, err = unix.Seek(int(s.Fd()), start, unix.SEEK_HOLE); err != nil {
+			return 0, 0, err
+		}
+		if end > s.size {
+			end = s.size
+		}
+	}
+	if _, err = s.File.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	hole, s.pos = start-s.pos, start
+	return hole, end - start, nil
+}
+
+// punchHole deallocates n bytes at off, or writes zeros where the file system cannot
+func punchHole(f *os.File, off, n int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return zeroFill(f, off, n)
+	}
+	return err
+}
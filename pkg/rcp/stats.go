@@ -0,0 +1,77 @@
+package rcp
+
+import (
+	"sort"
+	"time"
+)
+
+type speedSample struct {
+	t     time.Time
+	bytes uint64
+}
+
+// speedWindow calculates the average speed over a moving time window
+type speedWindow struct {
+	d       time.Duration
+	samples []speedSample
+}
+
+func newSpeedWindow(d time.Duration) *speedWindow {
+	return &speedWindow{d: d}
+}
+
+// add a sample of the total byte count and return the average speed in the window
+func (w *speedWindow) add(t time.Time, bytes uint64) uint64 {
+	w.samples = append(w.samples, speedSample{t, bytes})
+	i := 0
+	for i < len(w.samples)-2 && t.Sub(w.samples[i+1].t) >= w.d {
+		i++
+	}
+	w.samples = w.samples[i:]
+	if len(w.samples) < 2 {
+		return 0
+	}
+	first := w.samples[0]
+	return uint64(float64(bytes-first.bytes) / t.Sub(first.t).Seconds())
+}
+
+// ewmaAlpha returns the smoothing factor equivalent to an N-sample moving average
+func ewmaAlpha(window time.Duration) float64 {
+	n := window.Seconds()
+	if n < 1 {
+		n = 1
+	}
+	return 2 / (n + 1)
+}
+
+func ewma(prev, curr uint64, alpha float64, first bool) uint64 {
+	if first {
+		return curr
+	}
+	return uint64(alpha*float64(curr) + (1-alpha)*float64(prev))
+}
+
+func eta(total int64, size uint64, byteSec uint64) time.Duration {
+	if total <= 0 || byteSec == 0 || int64(size) >= total {
+		return 0
+	}
+	return time.Duration(float64(uint64(total)-size) / float64(byteSec) * float64(time.Second))
+}
+
+// speedSummary returns min, p50 and p95 of the speed samples
+func speedSummary(speeds []uint64) (min, p50, p95 uint64) {
+	if len(speeds) == 0 {
+		return
+	}
+	sorted := append([]uint64(nil), speeds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[0], percentile(sorted, 50), percentile(sorted, 95)
+}
+
+func percentile(sorted []uint64, p int) uint64 {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
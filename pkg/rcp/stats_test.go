@@ -0,0 +1,117 @@
+package rcp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpeedWindow(t *testing.T) {
+	// steady returns a sample a second at rate from the bytes of the last sample of s
+	steady := func(s [][2]uint64, secs, rate uint64) [][2]uint64 {
+		sec, bytes := uint64(0), uint64(0)
+		if len(s) > 0 {
+			sec, bytes = s[len(s)-1][0], s[len(s)-1][1]
+		}
+		for i := uint64(1); i <= secs; i++ {
+			s = append(s, [2]uint64{sec + i, bytes + i*rate})
+		}
+		return s
+	}
+	tests := []struct {
+		name    string
+		window  time.Duration
+		samples [][2]uint64 // seconds and total bytes
+		want    uint64
+	}{
+		{"one sample", 5 * time.Second, [][2]uint64{{0, 100}}, 0},
+		{"two samples", 5 * time.Second, [][2]uint64{{0, 0}, {2, 300}}, 150},
+		{"steady", 5 * time.Second, steady([][2]uint64{{0, 0}}, 20, 100), 100},
+		{"faster", 5 * time.Second, steady(steady([][2]uint64{{0, 0}}, 10, 100), 10, 1000), 1000},
+		{"slower in the window", 5 * time.Second, steady(steady([][2]uint64{{0, 0}}, 10, 1000), 3, 0), 400},
+		{"long gap", 5 * time.Second, [][2]uint64{{0, 0}, {1, 100}, {31, 3100}}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			w := newSpeedWindow(tt.window)
+			var got uint64
+			for _, s := range tt.samples {
+				got = w.add(start.Add(time.Duration(s[0])*time.Second), s[1])
+			}
+			if got != tt.want {
+				t.Fatalf("add() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	tests := []struct {
+		name       string
+		prev, curr uint64
+		alpha      float64
+		first      bool
+		want       uint64
+	}{
+		{"first", 100, 200, 0.5, true, 200},
+		{"half", 100, 200, 0.5, false, 150},
+		{"window of 9s", 100, 200, ewmaAlpha(9 * time.Second), false, 120},
+		{"window under 1s", 100, 200, ewmaAlpha(time.Millisecond), false, 200},
+		{"steady", 100, 100, ewmaAlpha(10 * time.Second), false, 100},
+	}
+	for _, tt := range tests {
+		if got := ewma(tt.prev, tt.curr, tt.alpha, tt.first); got != tt.want {
+			t.Errorf("%s: ewma() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		size    uint64
+		byteSec uint64
+		want    time.Duration
+	}{
+		{"size not known", 0, 100, 10, 0},
+		{"stalled", 1000, 100, 0, 0},
+		{"done", 1000, 1000, 10, 0},
+		{"beyond the total", 1000, 2000, 10, 0},
+		{"remaining", 1000, 100, 100, 9 * time.Second},
+		{"fraction", 1000, 0, 400, 2500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := eta(tt.total, tt.size, tt.byteSec); got != tt.want {
+			t.Errorf("%s: eta() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpeedSummary(t *testing.T) {
+	hundred := make([]uint64, 100)
+	for i := range hundred {
+		hundred[i] = uint64(100 - i)
+	}
+	tests := []struct {
+		name          string
+		speeds        []uint64
+		min, p50, p95 uint64
+	}{
+		{"none", nil, 0, 0, 0},
+		{"one", []uint64{7}, 7, 7, 7},
+		{"two", []uint64{9, 3}, 3, 3, 9},
+		{"hundred", hundred, 1, 50, 95},
+	}
+	for _, tt := range tests {
+		in := append([]uint64(nil), tt.speeds...)
+		min, p50, p95 := speedSummary(tt.speeds)
+		if min != tt.min || p50 != tt.p50 || p95 != tt.p95 {
+			t.Errorf("%s: speedSummary() = %d, %d, %d, want %d, %d, %d", tt.name, min, p50, p95, tt.min, tt.p50, tt.p95)
+		}
+		if !reflect.DeepEqual(tt.speeds, in) {
+			t.Errorf("%s: speedSummary() reordered its input", tt.name)
+		}
+	}
+}
@@ -1,34 +1,86 @@
 package rcp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
+	"time"
 )
 
+var errNotRawConn = errors.New("connection does not expose a file descriptor")
+
 type reciveStream struct {
 	ln   net.Listener
 	conn net.Conn
+
+	mu       sync.Mutex // guards conn against SetDeadline while it is replaced
+	deadline time.Time  // set once the copy is interrupted
+	nagle    bool       // the accepted connections delay small segments
+
+	// with --retries, the connections of the sender resuming the transfer
+	peer      net.Addr // the first connection, only its host can resume
+	resumes   chan net.Conn
+	accepting chan struct{} // closed once the listener stops accepting them
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func reciveStreamOpen(listen string) (*reciveStream, error) {
-	rs := &reciveStream{}
+// reciveStreamOpen accepts the first connection on listen, or gives up when ctx is done
+func reciveStreamOpen(ctx context.Context, lc *net.ListenConfig, listen string) (*reciveStream, error) {
+	rs := &reciveStream{closed: make(chan struct{})}
 	var err error
-	if rs.ln, err = net.Listen("tcp", listen); err != nil {
+	if rs.ln, err = lc.Listen(ctx, "tcp", listen); err != nil {
 		return nil, err
 	}
 	fmt.Printf("Listen: %s\n", listen)
-	if rs.conn, err = rs.ln.Accept(); err != nil {
+	accepted := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			rs.ln.Close()
+		case <-accepted:
+		}
+	}()
+	rs.conn, err = rs.ln.Accept()
+	close(accepted)
+	if err != nil {
+		rs.ln.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, err
 	}
 	return rs, nil
 }
 func (rs *reciveStream) Read(b []byte) (n int, err error) { return rs.conn.Read(b) }
+func (rs *reciveStream) SetDeadline(t time.Time) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.deadline = t
+	if ln, ok := rs.ln.(*net.TCPListener); ok {
+		ln.SetDeadline(t)
+	}
+	return rs.conn.SetDeadline(t)
+}
+func (rs *reciveStream) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := rs.conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNotRawConn
+}
 func (rs *reciveStream) Close() error {
-	if err := rs.conn.Close(); err != nil {
-		return err
+	rs.closeOnce.Do(func() { close(rs.closed) })
+	rs.mu.Lock()
+	err := rs.conn.Close()
+	rs.mu.Unlock()
+	if lerr := rs.ln.Close(); err == nil {
+		err = lerr
 	}
-	return rs.ln.Close()
+	return err
 }
 
 type dummyStream struct {
@@ -0,0 +1,405 @@
+package rcp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	uringOpRead  = 22 // IORING_OP_READ (Linux 5.6+)
+	uringOpWrite = 23 // IORING_OP_WRITE (Linux 5.6+)
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1
+)
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring minimal io_uring instance with one submission and one completion queue
+type uring struct {
+	fd       int
+	sqRing   []byte
+	cqRing   []byte
+	sqeMem   []byte
+	sqTail   *uint32
+	sqMask   uint32
+	sqArray  []uint32
+	sqes     []uringSQE
+	cqHead   *uint32
+	cqTail   *uint32
+	cqMask   uint32
+	cqes     []uringCQE
+	pending  uint32 // prepared but not submitted
+	inflight int    // submitted but not reaped
+}
+
+func newUring(entries int) (*uring, error) {
+	var p uringParams
+	fd, _, e := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, e
+	}
+	u := &uring{fd: int(fd)}
+	var err error
+	mmap := func(off int64, size int) ([]byte, error) {
+		return unix.Mmap(u.fd, off, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	}
+	if u.sqRing, err = mmap(uringOffSQRing, int(p.sqOff.array+p.sqEntries*4)); err != nil {
+		u.close()
+		return nil, err
+	}
+	if u.cqRing, err = mmap(uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))); err != nil {
+		u.close()
+		return nil, err
+	}
+	if u.sqeMem, err = mmap(uringOffSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(uringSQE{})))); err != nil {
+		u.close()
+		return nil, err
+	}
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.ringMask]))
+	u.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.array])), p.sqEntries)
+	u.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&u.sqeMem[0])), p.sqEntries)
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqRing[p.cqOff.ringMask]))
+	u.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&u.cqRing[p.cqOff.cqes])), p.cqEntries)
+	return u, nil
+}
+
+// prep queues a read or write of buf at off; the caller keeps buf alive until it is reaped
+func (u *uring) prep(op uint8, fd int, buf []byte, off int64, userData uint64) {
+	tail := atomic.LoadUint32(u.sqTail)
+	idx := tail & u.sqMask
+	u.sqes[idx] = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		userData: userData,
+	}
+	u.sqArray[idx] = idx
+	atomic.StoreUint32(u.sqTail, tail+1)
+	u.pending++
+}
+
+// enter submits the prepared requests and waits for at least minComplete completions
+func (u *uring) enter(minComplete int) error {
+	for {
+		n, _, e := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(u.pending), uintptr(minComplete), uringEnterGetEvents, 0, 0)
+		if e == unix.EINTR {
+			continue
+		}
+		if e != 0 {
+			return e
+		}
+		u.pending -= uint32(n)
+		u.inflight += int(n)
+		return nil
+	}
+}
+
+// reap calls fn for every completion in the completion queue
+func (u *uring) reap(fn func(userData uint64, res int32)) {
+	head := atomic.LoadUint32(u.cqHead)
+	tail := atomic.LoadUint32(u.cqTail)
+	for ; head != tail; head++ {
+		cqe := u.cqes[head&u.cqMask]
+		u.inflight--
+		fn(cqe.userData, cqe.res)
+	}
+	atomic.StoreUint32(u.cqHead, head)
+}
+
+// close waits for the requests in flight, so that their buffers are no longer used, and releases the ring
+func (u *uring) close() {
+	for u.sqes != nil && u.inflight > 0 {
+		if err := u.enter(u.inflight); err != nil {
+			break
+		}
+		u.reap(func(uint64, int32) {})
+	}
+	for _, b := range [][]byte{u.sqeMem, u.cqRing, u.sqRing} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(u.fd)
+}
+
+func uringErr(res int32) error {
+	if res < 0 {
+		return syscall.Errno(-res)
+	}
+	return nil
+}
+
+// uringAvailable reports whether the kernel lets rcp set up a ring, io_uring_setup fails on older kernels,
+// under seccomp or when kernel.io_uring_disabled is set
+func uringAvailable(use string) bool {
+	u, err := newUring(1)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "io_uring is not available (%s), using buffered %s\n", err, use)
+		return false
+	}
+	u.close()
+	return true
+}
+
+// uringReadWorker reads a regular file or a block device with up to QueueDepth reads in flight
+func (tc *threadCopy) uringReadWorker() func(context.Context, chan result) {
+	f, ok := tc.r.(*os.File)
+	if !ok {
+		return nil
+	}
+	fsize, err := fileSize(f)
+	if err != nil || fsize < 0 {
+		return nil
+	}
+	if !uringAvailable("reads") {
+		return nil
+	}
+	return func(ctx context.Context, res chan result) {
+		size := uint64(0)
+		var err error
+		defer close(tc.queue)
+		defer func() { res <- result{size, err}; close(res) }()
+		var start int64
+		if start, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		next := start
+		var u *uring
+		if u, err = newUring(tc.queueDepth); err != nil {
+			return
+		}
+		defer u.close()
+		fd := int(f.Fd())
+		end := tc.inputEnd(start, fsize)
+		submitted := next
+		inflight := map[uint64]*[]byte{}
+		done := map[int64]*[]byte{}
+		for next < end {
+			for submitted < end && len(inflight)+len(done) < tc.queueDepth {
+				buf := tc.bs.Get()
+				if buf == nil {
+					err = ctx.Err()
+					return
+				}
+				// keep the length aligned for O_DIRECT, the last read is short
+				if n := (end - submitted + blockAlign - 1) &^ (blockAlign - 1); n < int64(len(*buf)) {
+					*buf = (*buf)[:n]
+				}
+				u.prep(uringOpRead, fd, *buf, submitted, uint64(submitted))
+				inflight[uint64(submitted)] = buf
+				submitted += int64(len(*buf))
+			}
+			if err = u.enter(1); err != nil {
+				return
+			}
+			u.reap(func(off uint64, r int32) {
+				buf := inflight[off]
+				delete(inflight, off)
+				switch {
+				case r < 0:
+					err = uringErr(r)
+				case int(r) != len(*buf) && int64(off)+int64(r) < end:
+					err = io.ErrUnexpectedEOF
+				default:
+					if int64(off)+int64(r) > end {
+						// the aligned read went past the end of the range
+						r = int32(end - int64(off))
+					}
+					*buf = (*buf)[:r]
+					done[int64(off)] = buf
+				}
+			})
+			if err != nil {
+				return
+			}
+			for buf, ok := done[next]; ok; buf, ok = done[next] {
+				delete(done, next)
+				select {
+				case <-ctx.Done():
+					return
+				case tc.queue <- chunk{buf: buf, off: next - start}:
+				}
+				atomic.AddUint64(&tc.inputBytes, uint64(len(*buf)))
+				size += uint64(len(*buf))
+				next += int64(len(*buf))
+			}
+		}
+		err = io.EOF
+	}
+}
+
+// uringWriteWorker writes a regular file or a block device with up to QueueDepth writes in flight
+func (tc *threadCopy) uringWriteWorker() func(context.Context, chan result) {
+	fw, ok := tc.w.(*fileWriter)
+	if !ok {
+		return nil
+	}
+	f := fw.f
+	if fsize, err := fileSize(f); err != nil || fsize < 0 {
+		return nil
+	}
+	if !uringAvailable("writes") {
+		return nil
+	}
+	return func(ctx context.Context, res chan result) {
+		size := uint64(0)
+		var err error
+		defer func() { res <- result{size, err}; close(res) }()
+		var base int64
+		if base, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		var u *uring
+		if u, err = newUring(tc.queueDepth); err != nil {
+			return
+		}
+		defer u.close()
+		fd := int(f.Fd())
+		id := uint64(0)
+		inflight := map[uint64]chunk{}
+		reapFunc := func(id uint64, r int32) {
+			ch := inflight[id]
+			delete(inflight, id)
+			switch {
+			case r < 0:
+				err = uringErr(r)
+			case int(r) != len(*ch.buf):
+				err = io.ErrShortWrite
+			default:
+				atomic.AddUint64(&tc.outputBytes, uint64(r))
+				size += uint64(r)
+				tc.written.add(ch.off, int64(r))
+				tc.bs.Put(ch.buf)
+			}
+		}
+		wait := func(n int) error {
+			if err := u.enter(n); err != nil {
+				return err
+			}
+			u.reap(reapFunc)
+			return err
+		}
+		for {
+			var ch chunk
+			ok := true
+			switch {
+			case len(inflight) >= tc.queueDepth:
+			case len(inflight) == 0:
+				select {
+				case <-ctx.Done():
+					return
+				case ch, ok = <-tc.queue:
+				}
+			default:
+				select {
+				case <-ctx.Done():
+					// the writes in flight complete before the output is closed
+					wait(len(inflight))
+					return
+				case ch, ok = <-tc.queue:
+				default:
+				}
+			}
+			buf := ch.buf
+			if !ok {
+				err = wait(len(inflight))
+				return
+			}
+			if ch == (chunk{}) {
+				if err = wait(1); err != nil {
+					return
+				}
+				continue
+			}
+			if buf == nil {
+				if err = fw.WriteHoleAt(base+ch.off, ch.hole); err != nil {
+					return
+				}
+				atomic.AddUint64(&tc.skippedBytes, uint64(ch.hole))
+				size += uint64(ch.hole)
+				tc.written.add(ch.off, ch.hole)
+				continue
+			}
+			if len(*buf) == 0 {
+				tc.bs.Put(buf)
+				continue
+			}
+			if fw.direct && len(*buf)%blockAlign != 0 {
+				// the unaligned tail is written without O_DIRECT once everything before it is written
+				if err = wait(len(inflight)); err != nil {
+					return
+				}
+				var c int
+				if c, err = fw.WriteAt(*buf, base+ch.off); err != nil {
+					return
+				}
+				atomic.AddUint64(&tc.outputBytes, uint64(c))
+				size += uint64(c)
+				tc.written.add(ch.off, int64(c))
+				tc.bs.Put(buf)
+				continue
+			}
+			u.prep(uringOpWrite, fd, *buf, base+ch.off, id)
+			inflight[id] = ch
+			id++
+			if err = wait(0); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package rcp
+
+import "context"
+
+// uringReadWorker io_uring is only implemented on Linux
+func (tc *threadCopy) uringReadWorker() func(context.Context, chan result) { return nil }
+
+// uringWriteWorker io_uring is only implemented on Linux
+func (tc *threadCopy) uringWriteWorker() func(context.Context, chan result) { return nil }
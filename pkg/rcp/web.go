@@ -0,0 +1,247 @@
+package rcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	webHistory = 3600
+)
+
+// WebDashboard serves the speed dashboard as a web page fed by Server-Sent Events
+type WebDashboard struct {
+	mux     *http.ServeMux
+	mu      sync.Mutex
+	samples []webSample
+	subs    map[chan webSample]struct{}
+	closed  bool
+}
+
+type webSample struct {
+	InputName  string
+	OutputName string
+	TotalSize  int64
+	Done       bool
+	Error      string `json:",omitempty"`
+	Metrics
+}
+
+type webTransfer struct {
+	d      *WebDashboard
+	sample webSample
+}
+
+// NewWebDashboard create WebDashboard struct
+func NewWebDashboard() *WebDashboard {
+	d := &WebDashboard{
+		mux:  http.NewServeMux(),
+		subs: map[chan webSample]struct{}{},
+	}
+	d.mux.HandleFunc("/", d.serveIndex)
+	d.mux.HandleFunc("/events", d.serveEvents)
+	return d
+}
+
+// Transfer registers a transfer and returns the Observer feeding its metrics
+func (d *WebDashboard) Transfer(inputName, outputName string, total int64) Observer {
+	return d.transfer(inputName, outputName, total)
+}
+
+func (d *WebDashboard) transfer(inputName, outputName string, total int64) *webTransfer {
+	t := &webTransfer{d: d}
+	t.describe(inputName, outputName, total)
+	return t
+}
+
+// describe sets the names and the size of a transfer registered before its endpoints were open
+func (t *webTransfer) describe(inputName, outputName string, total int64) {
+	t.sample.InputName, t.sample.OutputName, t.sample.TotalSize = inputName, outputName, total
+}
+
+func (t *webTransfer) Observe(m Metrics) {
+	t.sample.Metrics = m
+	t.d.publish(t.sample)
+}
+
+func (t *webTransfer) Done(err error) {
+	if t.sample.Done {
+		// a transfer that failed to start is done once
+		return
+	}
+	t.sample.Done = true
+	if err != nil {
+		t.sample.Error = err.Error()
+	}
+	t.d.publish(t.sample)
+}
+
+func (d *WebDashboard) publish(s webSample) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples = append(d.samples, s)
+	if len(d.samples) > webHistory {
+		d.samples = d.samples[len(d.samples)-webHistory:]
+	}
+	for ch := range d.subs {
+		select {
+		case ch <- s:
+		default: // slow client, drop the sample
+		}
+	}
+}
+
+func (d *WebDashboard) subscribe() (chan webSample, []webSample) {
+	ch := make(chan webSample, chanSize)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		close(ch)
+	} else {
+		d.subs[ch] = struct{}{}
+	}
+	return ch, append([]webSample(nil), d.samples...)
+}
+
+func (d *WebDashboard) unsubscribe(ch chan webSample) {
+	d.mu.Lock()
+	delete(d.subs, ch)
+	d.mu.Unlock()
+}
+
+// close ends the event streams once they sent the samples already published
+func (d *WebDashboard) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for ch := range d.subs {
+		close(ch)
+		delete(d.subs, ch)
+	}
+}
+
+func (d *WebDashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mux.ServeHTTP(w, req)
+}
+
+func (d *WebDashboard) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ch, history := d.subscribe()
+	defer d.unsubscribe(ch)
+	send := func(s webSample) error {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+		return err
+	}
+	for _, s := range history {
+		if err := send(s); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case s, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(s); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (d *WebDashboard) serveIndex(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, webIndex)
+}
+
+const webIndex = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>rcp</title>
+<style>
+body { background: #000; color: #fff; font-family: monospace; margin: 1em; }
+.chart { border: 1px solid #fff; margin-bottom: 1em; padding: 0.3em; }
+.chart canvas { width: 100%; height: 160px; display: block; }
+.title { white-space: pre; }
+#input .title { color: #0c0; }
+#output .title { color: #c00; }
+#buffer .title { color: #cc0; }
+#progress .title { color: #0cc; }
+#bar { background: #0c0; height: 1.2em; width: 0; text-align: center; color: #000; }
+</style>
+</head>
+<body>
+<div id="status">waiting for metrics...</div>
+<div class="chart" id="input"><div class="title"></div><canvas></canvas></div>
+<div class="chart" id="output"><div class="title"></div><canvas></canvas></div>
+<div class="chart" id="buffer"><div class="title"></div><canvas></canvas></div>
+<div class="chart" id="progress"><div class="title"></div><div id="bar"></div></div>
+<script>
+function bytes(n) {
+  var units = ["B", "kB", "MB", "GB", "TB", "PB"], i = 0;
+  while (n >= 1000 && i < units.length - 1) { n /= 1000; i++; }
+  return (i == 0 ? n.toFixed(0) : n.toFixed(1)) + " " + units[i];
+}
+function comma(n) { return n.toLocaleString("en-US"); }
+var series = { input: [], output: [], buffer: [] };
+var colors = { input: "#0c0", output: "#c00", buffer: "#cc0" };
+function draw(id) {
+  var c = document.querySelector("#" + id + " canvas");
+  c.width = c.clientWidth; c.height = c.clientHeight;
+  var data = series[id].slice(-c.width), max = Math.max.apply(null, data.concat([1]));
+  var ctx = c.getContext("2d");
+  ctx.fillStyle = colors[id];
+  data.forEach(function (v, i) {
+    var h = v / max * c.height;
+    ctx.fillRect(c.width - data.length + i, c.height - h, 1, h);
+  });
+}
+function title(id, text) { document.querySelector("#" + id + " .title").textContent = text; }
+function update(m) {
+  if (!m.Done) {
+    series.input.push(m.InputByteSec);
+    series.output.push(m.OutputByteSec);
+    series.buffer.push(m.BufferUsed);
+  }
+  title("input", "Input [" + m.InputName + "] " + bytes(m.InputByteSec) + "/sec (max: " + bytes(m.InputMaxByteSec) + "/sec)");
+  title("output", "Output [" + m.OutputName + "] " + bytes(m.OutputByteSec) + "/sec (max: " + bytes(m.OutputMaxByteSec) + "/sec)");
+  title("buffer", "Buffer used: " + bytes(m.BufferUsed) + " (max: " + bytes(m.BufferMaxUsed) + ")");
+  title("progress", "Progress:[" + comma(m.Size) + " / " + comma(m.TotalSize) + " Byte], Average speed:[" + bytes(m.AvgByteSec) + "/sec]");
+  var pct = m.TotalSize > 0 ? Math.min(100, Math.floor(m.Size / m.TotalSize * 100)) : 0;
+  var bar = document.getElementById("bar");
+  bar.style.width = pct + "%"; bar.textContent = pct + "%";
+  document.getElementById("status").textContent = m.Done ? (m.Error ? "failed: " + m.Error : "done") : "running";
+  ["input", "output", "buffer"].forEach(draw);
+}
+var es = new EventSource("events");
+es.onmessage = function (e) {
+  var m = JSON.parse(e.data);
+  update(m);
+  if (m.Done) es.close(); // the server stops after --metrics-linger
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,214 @@
+package rcp
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	maxPipeSize = 1 << 20
+)
+
+// zeroCopyFunc returns sendfile(2) for file->socket and splice(2) for socket->file copies,
+// or nil when the endpoints do not allow it
+func (tc *threadCopy) zeroCopyFunc() copyFunc {
+	f, rIsFile := tc.r.(*os.File)
+	pr, rIsProto := tc.r.(*protoReader)
+	pw, wIsProto := tc.w.(*protoWriter)
+	fw, wIsFile := tc.w.(*fileWriter)
+	switch {
+	case rIsFile && wIsProto && pw.delta == nil && pw.chunks == nil && pw.retry == nil:
+		return func(ctx context.Context, wg *sync.WaitGroup) (int64, error) {
+			return tc.sendfile(ctx, f, pw)
+		}
+	case rIsProto && wIsFile && !fw.direct && pr.sigs == nil && pr.chunks == nil && pr.header.RetryWait == 0:
+		return func(ctx context.Context, wg *sync.WaitGroup) (int64, error) {
+			return tc.splice(ctx, pr, fw)
+		}
+	}
+	return nil
+}
+
+func rawFd(c syscall.Conn) (raw syscall.RawConn, fd int, err error) {
+	if raw, err = c.SyscallConn(); err != nil {
+		return
+	}
+	err = raw.Control(func(f uintptr) { fd = int(f) })
+	return
+}
+
+func (tc *threadCopy) count(n int) {
+	atomic.AddUint64(&tc.inputBytes, uint64(n))
+	atomic.AddUint64(&tc.outputBytes, uint64(n))
+}
+
+// sendfile sends src as data frames of up to bufSize bytes
+func (tc *threadCopy) sendfile(ctx context.Context, src *os.File, dst *protoWriter) (int64, error) {
+	fsize, err := fileSize(src)
+	if err != nil {
+		return 0, err
+	}
+	// frames go through dst, the payload past it
+	conn, ok := dst.conn.(syscall.Conn)
+	if !ok {
+		return 0, errNotRawConn
+	}
+	rawDst, _, err := rawFd(conn)
+	if err != nil {
+		return 0, err
+	}
+	srcFd := int(src.Fd())
+	start, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	total := tc.inputEnd(start, fsize) - start
+	size := int64(0)
+	for size < total {
+		select {
+		case <-ctx.Done():
+			return size, ctx.Err()
+		default:
+		}
+		frame := total - size
+		if frame > int64(tc.bufSize) {
+			frame = int64(tc.bufSize)
+		}
+		if err = dst.writeFrame(frameData, frame); err != nil {
+			return size, err
+		}
+		// the frame is cut short unless all of it is sent
+		dst.torn = true
+		for frame > 0 {
+			var n int
+			var serr error
+			if err = rawDst.Write(func(fd uintptr) bool {
+				n, serr = unix.Sendfile(int(fd), srcFd, nil, int(frame))
+				return serr != unix.EAGAIN
+			}); err != nil {
+				return size, err
+			}
+			if serr != nil {
+				return size, serr
+			}
+			if n == 0 {
+				return size, io.ErrUnexpectedEOF
+			}
+			frame -= int64(n)
+			size += int64(n)
+			dst.sent += int64(n)
+			tc.count(n)
+		}
+		dst.torn = false
+	}
+	return size, nil
+}
+
+// splice wraps unix.Splice whose count type differs between architectures
+func splice(rfd, wfd, n, flags int) (int64, error) {
+	c, err := unix.Splice(rfd, nil, wfd, nil, n, flags)
+	return int64(c), err
+}
+
+// splice moves the data frames of src into dst through a pipe and recreates the holes
+func (tc *threadCopy) splice(ctx context.Context, src *protoReader, dst *fileWriter) (int64, error) {
+	conn, ok := src.rc.(syscall.Conn)
+	if !ok {
+		return 0, errNotRawConn
+	}
+	rawSrc, _, err := rawFd(conn)
+	if err != nil {
+		return 0, err
+	}
+	dstFd := int(dst.f.Fd())
+	var p [2]int
+	if err = unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return 0, err
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	pipeSize := maxPipeSize
+	if tc.bufSize < pipeSize {
+		pipeSize = tc.bufSize
+	}
+	if s, err := unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, pipeSize); err == nil {
+		pipeSize = s
+	}
+	size := int64(0)
+	if src.isRaw && len(src.raw) > 0 {
+		// the bytes read while looking for protoMagic
+		n, err := dst.Write(src.raw)
+		tc.written.add(size, int64(n))
+		size += int64(n)
+		tc.count(n)
+		if err != nil {
+			return size, err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return size, ctx.Err()
+		default:
+		}
+		hole, data, err := src.ReadHole()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		if hole > 0 {
+			if err = dst.WriteHole(hole); err != nil {
+				return size, err
+			}
+			tc.written.add(size, hole)
+			size += hole
+			atomic.AddUint64(&tc.skippedBytes, uint64(hole))
+			continue
+		}
+		want := pipeSize
+		if data < int64(want) {
+			want = int(data)
+		}
+		var n int64
+		var serr error
+		if err = rawSrc.Read(func(fd uintptr) bool {
+			n, serr = splice(int(fd), p[1], want, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return serr != unix.EAGAIN
+		}); err != nil {
+			return size, err
+		}
+		if serr != nil {
+			return size, serr
+		}
+		if n == 0 {
+			if src.isRaw {
+				return size, nil
+			}
+			return size, io.ErrUnexpectedEOF
+		}
+		src.remain -= n
+		atomic.AddUint64(&tc.inputBytes, uint64(n))
+		for n > 0 {
+			var m int64
+			if m, err = splice(p[0], dstFd, int(n), unix.SPLICE_F_MOVE); err != nil {
+				return size, err
+			}
+			if m == 0 {
+				return size, io.ErrShortWrite
+			}
+			n -= m
+			tc.written.add(size, m)
+			size += m
+			dst.pos += m
+			atomic.AddUint64(&tc.outputBytes, uint64(m))
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package rcp
+
+// zeroCopyFunc zero-copy is only implemented on Linux
+func (tc *threadCopy) zeroCopyFunc() copyFunc { return nil }